@@ -0,0 +1,247 @@
+package apachelog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// OverflowPolicy specifies what an AsyncWriter does when its queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes writers wait until there is room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the line being written
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest line in the queue to make
+	// room for the line being written
+	OverflowDropOldest
+)
+
+const defaultQueueSize = 1024
+
+// ErrWriterClosed is returned when writing to an AsyncWriter that has
+// already been closed
+var ErrWriterClosed = errors.New("writer has been closed")
+
+// AsyncWriter is an io.Writer that queues each write, and writes it to
+// the underlying io.Writer from a background goroutine. This keeps a
+// slow destination from adding latency to each request when used with
+// ApacheLog.Wrap
+//
+//	w := apachelog.NewAsyncWriter(f, apachelog.WithOverflowPolicy(apachelog.OverflowDropOldest))
+//	defer w.Close(ctx)
+//	http.ListenAndServe(":8080", apachelog.CombinedLog.Wrap(mux, w))
+//
+// Each call to Write is expected to contain a single log line, which
+// is copied before Write returns.
+type AsyncWriter struct {
+	dst     io.Writer
+	policy  OverflowPolicy
+	queue   chan []byte
+	closing chan struct{} // closed when Close is called
+	done    chan struct{} // closed when the queue has been drained
+
+	mu        sync.Mutex
+	closed    bool
+	enqueued  uint64
+	processed uint64
+	dropped   uint64
+	failed    uint64
+	progress  chan struct{}
+}
+
+// NewAsyncWriter creates a new AsyncWriter that writes to dst.
+// WithQueueSize and WithOverflowPolicy may be used to configure it.
+// By default up to 1024 lines are queued, and writers block when the
+// queue is full.
+//
+// If dst implements `Flush() error` (e.g. *bufio.Writer), it is flushed
+// whenever the queue becomes empty.
+func NewAsyncWriter(dst io.Writer, options ...Option) *AsyncWriter {
+	size := defaultQueueSize
+	policy := OverflowBlock
+	for _, o := range options {
+		switch o.Name() {
+		case optkeyQueueSize:
+			size = o.Value().(int)
+		case optkeyOverflowPolicy:
+			policy = o.Value().(OverflowPolicy)
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	w := &AsyncWriter{
+		dst:      dst,
+		policy:   policy,
+		queue:    make(chan []byte, size),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		progress: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+
+	f, _ := w.dst.(flusher)
+	for {
+		select {
+		case b := <-w.queue:
+			w.process(b, f)
+		case <-w.closing:
+			// Nothing is queued once closing has been closed, so
+			// the queue only needs to be drained
+			for {
+				select {
+				case b := <-w.queue:
+					w.process(b, f)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *AsyncWriter) process(b []byte, f flusher) {
+	_, err := w.dst.Write(b)
+	if err == nil && f != nil && len(w.queue) == 0 {
+		err = f.Flush()
+	}
+
+	w.mu.Lock()
+	if err != nil {
+		w.failed++
+	}
+	w.markProcessed()
+	w.mu.Unlock()
+}
+
+// markProcessed must be called with w.mu held
+func (w *AsyncWriter) markProcessed() {
+	w.processed++
+	close(w.progress)
+	w.progress = make(chan struct{})
+}
+
+// Write queues a copy of p to be written to the underlying writer.
+// When the queue is full, the behavior depends on the OverflowPolicy.
+// Lines that are dropped are not reported as errors, but are counted
+// and can be retrieved via Dropped. Writers that are blocked on a full
+// queue when Close is called give up, and return ErrWriterClosed
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	// Lines are only queued while holding w.mu, so that they are
+	// counted before they can be processed, and so that nothing is
+	// queued once the writer has been closed
+	w.mu.Lock()
+	for {
+		if w.closed {
+			w.mu.Unlock()
+			return 0, ErrWriterClosed
+		}
+
+		select {
+		case w.queue <- b:
+			w.enqueued++
+			w.mu.Unlock()
+			return len(p), nil
+		default:
+		}
+
+		switch w.policy {
+		case OverflowDropNewest:
+			w.dropped++
+			w.mu.Unlock()
+			return len(p), nil
+		case OverflowDropOldest:
+			select {
+			case <-w.queue:
+				w.dropped++
+				w.markProcessed()
+			default:
+			}
+		default:
+			progress := w.progress
+			w.mu.Unlock()
+			select {
+			case <-progress:
+			case <-w.closing:
+			}
+			w.mu.Lock()
+		}
+	}
+}
+
+// Dropped returns the number of lines that were dropped because the
+// queue was full
+func (w *AsyncWriter) Dropped() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Failed returns the number of lines that could not be written to
+// the underlying writer
+func (w *AsyncWriter) Failed() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failed
+}
+
+// Flush waits until every line that was queued before the call has
+// been written to the underlying writer, or until ctx is done.
+func (w *AsyncWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	target := w.enqueued
+	w.mu.Unlock()
+
+	for {
+		w.mu.Lock()
+		if w.processed >= target {
+			w.mu.Unlock()
+			return nil
+		}
+		progress := w.progress
+		w.mu.Unlock()
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops accepting new lines, and waits until the queued lines
+// have been written or until ctx is done. The underlying writer is
+// not closed. If ctx is done first, the remaining lines continue to be
+// written in the background
+func (w *AsyncWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.closing)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,169 @@
+package apachelog_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	apachelog "github.com/lestrrat-go/apache-logformat/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter blocks every write until release is closed. Writes
+// are reported to started before blocking
+type blockingWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+	started chan struct{}
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		release: make(chan struct{}),
+		started: make(chan struct{}, 1),
+	}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestAsyncWriter(t *testing.T) {
+	dst := newBlockingWriter()
+	close(dst.release)
+
+	w := apachelog.NewAsyncWriter(dst)
+	s := httptest.NewServer(apachelog.CommonLog.Wrap(hello, w))
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(s.URL)
+		if !assert.NoError(t, err, "GET should succeed") {
+			return
+		}
+		res.Body.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if !assert.NoError(t, w.Flush(ctx), "Flush should succeed") {
+		return
+	}
+	assert.Equal(t, 3, bytes.Count([]byte(dst.String()), []byte("\n")), "expected 3 lines")
+
+	if !assert.NoError(t, w.Close(ctx), "Close should succeed") {
+		return
+	}
+	_, err := w.Write([]byte("too late\n"))
+	assert.Equal(t, apachelog.ErrWriterClosed, err)
+}
+
+func TestAsyncWriterOverflow(t *testing.T) {
+	policies := map[string]struct {
+		Policy   apachelog.OverflowPolicy
+		Expected string
+	}{
+		"DropNewest": {apachelog.OverflowDropNewest, "1\n2\n"},
+		"DropOldest": {apachelog.OverflowDropOldest, "1\n4\n"},
+	}
+
+	for name, c := range policies {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			dst := newBlockingWriter()
+			w := apachelog.NewAsyncWriter(dst,
+				apachelog.WithQueueSize(1),
+				apachelog.WithOverflowPolicy(c.Policy),
+			)
+
+			_, _ = w.Write([]byte("1\n"))
+			// wait for the background goroutine to pick up the first line
+			<-dst.started
+			for _, line := range []string{"2\n", "3\n", "4\n"} {
+				_, _ = w.Write([]byte(line))
+			}
+			close(dst.release)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if !assert.NoError(t, w.Close(ctx), "Close should succeed") {
+				return
+			}
+
+			assert.Equal(t, c.Expected, dst.String())
+			assert.Equal(t, uint64(2), w.Dropped())
+		})
+	}
+}
+
+func TestAsyncWriterFlushDeadline(t *testing.T) {
+	dst := newBlockingWriter()
+	defer close(dst.release)
+
+	w := apachelog.NewAsyncWriter(dst)
+	_, _ = w.Write([]byte("stuck\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.Flush(ctx))
+}
+
+func TestAsyncWriterCloseDeadline(t *testing.T) {
+	dst := newBlockingWriter()
+	defer close(dst.release)
+
+	w := apachelog.NewAsyncWriter(dst, apachelog.WithQueueSize(1))
+	_, _ = w.Write([]byte("1\n"))
+	// wait for the background goroutine to pick up the first line
+	<-dst.started
+	_, _ = w.Write([]byte("2\n"))
+
+	// The queue is full, so this write blocks until the writer is
+	// closed. If Close happens to be called first, it gives up right
+	// away, which must be reported in the same way
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("3\n"))
+		blocked <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close(ctx) }()
+
+	select {
+	case err := <-closed:
+		assert.Equal(t, context.DeadlineExceeded, err, "Close should give up when ctx is done")
+	case <-time.After(2 * time.Second):
+		t.Errorf("Close did not honour the deadline")
+		return
+	}
+
+	select {
+	case err := <-blocked:
+		assert.Equal(t, apachelog.ErrWriterClosed, err, "blocked writer should give up when the writer is closed")
+	case <-time.After(2 * time.Second):
+		t.Errorf("blocked writer was not released")
+	}
+}
@@ -0,0 +1,130 @@
+package apachelog
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CompileError describes a problem found while compiling a format.
+// Errors returned by New and friends when the format can not be
+// compiled have a *CompileError as their cause, which can be retrieved
+// using errors.Cause.
+//
+// Problems that can be worked around, such as unknown directives, are
+// only errors in strict mode (see WithStrictCompile). Otherwise they
+// are reported via ApacheLog.Warnings and Format.Warnings
+type CompileError struct {
+	// Offset is the byte offset of the offending directive in the format
+	Offset int
+	// Directive is the offending directive as it was written, e.g. "%Z"
+	Directive string
+	// Suggestion is a hint on how to fix the problem. It may be empty
+	Suggestion string
+	// Err is the underlying error, such as ErrUnimplemented
+	Err error
+}
+
+func (e *CompileError) Error() string {
+	var b strings.Builder
+	b.WriteString("offset ")
+	b.WriteString(strconv.Itoa(e.Offset))
+	if e.Directive != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Directive)
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	if e.Suggestion != "" {
+		b.WriteString(" (")
+		b.WriteString(e.Suggestion)
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying error
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// errUnexpectedKey is the error of directives that were given a key,
+// but do not take one
+var errUnexpectedKey = errors.New("directive does not take a key")
+
+// directiveKeys lists the keys accepted by directives that only take
+// a fixed set of keys, for use in suggestions
+var directiveKeys = map[string][]string{
+	"a": {"c"},
+	"p": {"canonical", "local", "remote"},
+	"P": {"pid", "tid", "hextid"},
+	"s": {"1xx", "superfluous"},
+	"T": {"s", "ms", "us"},
+	"x": append(append([]string{}, traceKeys...), tlsKeys...),
+}
+
+// keyedSyntax describes the syntax of directives that require a key,
+// for use in suggestions
+var keyedSyntax = map[string]string{
+	"C": "%{name}C for a request cookie, or %{set:name}C for a cookie set by the response",
+	"n": "%{name}n for a note set via SetNote",
+}
+
+// suggestFix returns a hint for fixing a directive that failed to
+// compile with err
+func (f *Format) suggestFix(verb, key string, err error) string {
+	if keys, ok := directiveKeys[verb]; ok && key != "" {
+		return "use one of " + strings.Join(keys, ", ")
+	}
+
+	if err == errUnexpectedKey {
+		if alt := swapCase(verb); alt != verb && !keylessVerbs[alt] {
+			if fld, err := f.makeField(alt, key); err == nil && fld != nil {
+				return "did you mean %{" + key + "}" + alt + "?"
+			}
+		}
+		return "use %" + verb + " without a key"
+	}
+
+	if err != ErrUnimplemented {
+		return ""
+	}
+
+	if syntax, ok := keyedSyntax[verb]; ok && key == "" {
+		return "use " + syntax
+	}
+
+	if alt := swapCase(verb); alt != verb && (key == "" || !keylessVerbs[alt]) {
+		if fld, err := f.makeField(alt, key); err == nil && fld != nil {
+			if key != "" {
+				return "did you mean %{" + key + "}" + alt + "?"
+			}
+			return "did you mean %" + alt + "?"
+		}
+	}
+
+	if key != "" {
+		return "use %{" + key + "}i for a request header, or %{" + key + "}o for a response header"
+	}
+
+	// A '%' that is not followed by a letter, as in "100% sure", was
+	// most likely meant to be literal
+	if r, _ := utf8.DecodeRuneInString(verb); !unicode.IsLetter(r) {
+		return "use %% for a literal percent sign"
+	}
+	return ""
+}
+
+// swapCase returns verb with the case of its first letter swapped
+func swapCase(verb string) string {
+	r, n := utf8.DecodeRuneInString(verb)
+	switch {
+	case unicode.IsUpper(r):
+		return string(unicode.ToLower(r)) + verb[n:]
+	case unicode.IsLower(r):
+		return string(unicode.ToUpper(r)) + verb[n:]
+	}
+	return verb
+}
@@ -0,0 +1,75 @@
+package apachelog
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// scanStatusCondition returns the length of the status condition at
+// the start of s, such as "400,501" or "!200,304", which may follow
+// the '%' of any directive
+func scanStatusCondition(s string) int {
+	i := 0
+	if i < len(s) && s[i] == '!' {
+		i++
+	}
+	for i < len(s) && (s[i] == ',' || (s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	return i
+}
+
+// parseStatusCondition parses a status condition, as found by
+// scanStatusCondition
+func parseStatusCondition(s string) (statuses []int, negate bool, err error) {
+	if strings.HasPrefix(s, "!") {
+		negate = true
+		s = s[1:]
+	}
+	if s == "" {
+		return nil, false, errors.New("status condition does not contain any status codes")
+	}
+
+	for _, code := range strings.Split(s, ",") {
+		st, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, false, errors.Errorf("invalid status code %s in status condition", strconv.Quote(code))
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, negate, nil
+}
+
+// conditionalField wraps a Field so that its value is only logged for
+// responses whose status is (or, if negated, is not) one of statuses.
+// Otherwise it is logged as a missing value, like Apache
+type conditionalField struct {
+	field    Field
+	negate   bool
+	statuses []int
+}
+
+func (c *conditionalField) match(status int) bool {
+	for _, st := range c.statuses {
+		if st == status {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+func (c *conditionalField) Extract(ctx LogCtx) Value {
+	if !c.match(ctx.ResponseStatus()) {
+		return MissingValue()
+	}
+	return c.field.Extract(ctx)
+}
+
+func (c *conditionalField) appendText(dst []byte, v Value) []byte {
+	if ta, ok := c.field.(textAppender); ok {
+		return ta.appendText(dst, v)
+	}
+	return v.appendText(dst)
+}
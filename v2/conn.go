@@ -0,0 +1,327 @@
+package apachelog
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lestrrat-go/apache-logformat/v2/internal/httputil"
+)
+
+// connInfo is the state of a single connection, shared by all of the
+// requests that it serves
+type connInfo struct {
+	// requests and closed are accessed atomically, and must be kept at
+	// the top of the struct to be 64-bit aligned
+	requests int64
+	closed   int32
+
+	// conn counts the bytes transferred on the connection. It is nil
+	// if the connection was not accepted by a listener created by
+	// ConnTracker.Listener
+	conn *httputil.CountingConn
+
+	mu      sync.Mutex
+	tracked bool                         // ConnState is called for the connection
+	done    bool                         // the connection was closed or hijacked
+	read    int64                        // bytes read when the last response was sent
+	written int64                        // bytes written when the last response was sent
+	pending []func(received, sent int64) // called when the response is sent
+}
+
+// afterResponseSent registers fn to be called once the current
+// response has been sent. It returns false if the bytes transferred on
+// the connection are not counted, or if ConnState is not called for
+// the connection, as fn would then never be called
+func (ci *connInfo) afterResponseSent(fn func(received, sent int64)) bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if ci.conn == nil || !ci.tracked || ci.done {
+		return false
+	}
+	ci.pending = append(ci.pending, fn)
+	return true
+}
+
+// responseSent calls the functions registered via afterResponseSent
+// with the number of bytes transferred since the previous response
+func (ci *connInfo) responseSent(final bool) {
+	var read, written int64
+	if ci.conn != nil {
+		read, written = ci.conn.BytesRead(), ci.conn.BytesWritten()
+	}
+
+	ci.mu.Lock()
+	pending := ci.pending
+	received, sent := read-ci.read, written-ci.written
+	ci.pending = nil
+	ci.read, ci.written = read, written
+	if final {
+		ci.done = true
+	}
+	ci.mu.Unlock()
+
+	for _, fn := range pending {
+		fn(received, sent)
+	}
+}
+
+type connInfoKey struct{}
+type keepAliveCountKey struct{}
+
+// ConnTracker keeps track of the connections of an http.Server, so
+// that %k can log the number of keep-alive requests served by each
+// connection, and %X can tell if the client went away. It is
+// installed on the server via Install, or by setting its ConnContext
+// and ConnState methods as the hooks of the same name
+//
+//	srv := &http.Server{Handler: apachelog.CombinedLog.Wrap(mux, os.Stdout)}
+//	apachelog.NewConnTracker().Install(srv)
+//
+// If the listener of the server is also wrapped using Listener, %I, %O
+// and %S log the number of bytes that were actually transferred on the
+// connection for HTTP/1.x requests, instead of estimates. The log lines
+// of formats that use them are then written once ConnState reports
+// that the response has been sent
+//
+//	t := apachelog.NewConnTracker()
+//	t.Install(srv)
+//	srv.Serve(t.Listener(l))
+type ConnTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*connInfo
+}
+
+// NewConnTracker creates a new ConnTracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		conns: make(map[net.Conn]*connInfo),
+	}
+}
+
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return httputil.NewCountingConn(c), nil
+}
+
+// countingConn returns the connection accepted by a listener created
+// by ConnTracker.Listener that c is, or that c wraps, such as when c is
+// a *tls.Conn. It returns nil if there is none
+func countingConn(c net.Conn) *httputil.CountingConn {
+	for c != nil {
+		if cc, ok := c.(*httputil.CountingConn); ok {
+			return cc
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = u.NetConn()
+	}
+	return nil
+}
+
+// Listener wraps l, so that the bytes transferred on the connections
+// that it accepts are counted. If the server uses TLS, as with
+// http.Server.ServeTLS, the counts include the overhead of TLS. This
+// requires Go 1.18 or later, where tls.Conn exposes the connection that
+// it wraps: with earlier versions, estimates are logged for TLS
+// connections instead.
+//
+// The bytes are counted as they are read from the connection, so when
+// a client pipelines requests, the part of the next request that
+// net/http reads ahead is counted as received for the current one
+func (t *ConnTracker) Listener(l net.Listener) net.Listener {
+	return countingListener{Listener: l}
+}
+
+// Install sets the ConnContext and ConnState hooks of srv. Hooks that
+// were already set are called before those of the tracker
+func (t *ConnTracker) Install(srv *http.Server) {
+	prevContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if prevContext != nil {
+			ctx = prevContext(ctx, c)
+		}
+		return t.ConnContext(ctx, c)
+	}
+
+	prevState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if prevState != nil {
+			prevState(c, state)
+		}
+		t.ConnState(c, state)
+	}
+}
+
+// ConnContext is meant to be used as http.Server.ConnContext. It
+// attaches the state of the connection c to ctx
+func (t *ConnTracker) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	ci := &connInfo{conn: countingConn(c)}
+
+	t.mu.Lock()
+	t.conns[c] = ci
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+// ConnState is meant to be used as http.Server.ConnState. It records
+// when a response has been sent, and when a connection is closed or
+// hijacked
+func (t *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		t.mu.Lock()
+		ci, ok := t.conns[c]
+		t.mu.Unlock()
+		if ok {
+			ci.mu.Lock()
+			ci.tracked = true
+			ci.mu.Unlock()
+		}
+	case http.StateIdle:
+		t.mu.Lock()
+		ci, ok := t.conns[c]
+		t.mu.Unlock()
+		if ok {
+			ci.responseSent(false)
+		}
+	case http.StateClosed, http.StateHijacked:
+		t.mu.Lock()
+		ci, ok := t.conns[c]
+		delete(t.conns, c)
+		t.mu.Unlock()
+		if ok {
+			atomic.StoreInt32(&ci.closed, 1)
+			ci.responseSent(true)
+		}
+	}
+}
+
+// requestAborted reports if the client went away before the response
+// to r was completed
+func requestAborted(r *http.Request) bool {
+	if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok && atomic.LoadInt32(&ci.closed) == 1 {
+		return true
+	}
+	return r.Context().Err() != nil
+}
+
+// afterResponseSent registers fn to be called with the number of bytes
+// transferred for r, once its response has been sent. It returns false
+// if the bytes are not counted on the connection of r
+func afterResponseSent(r *http.Request, fn func(received, sent int64)) bool {
+	if r.ProtoMajor != 1 {
+		return false
+	}
+	ci, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return false
+	}
+	return ci.afterResponseSent(fn)
+}
+
+// withKeepAliveCount counts the request r on its connection, if it is
+// tracked, and returns a copy of ctx that carries the number of
+// requests served on the connection before r. If ctx already carries
+// the count, e.g. because r was wrapped by another ApacheLog, ctx is
+// returned as is, so that r is only counted once
+func withKeepAliveCount(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := ctx.Value(keepAliveCountKey{}).(int64); ok {
+		return ctx
+	}
+	ci, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return ctx
+	}
+	n := atomic.AddInt64(&ci.requests, 1) - 1
+	return context.WithValue(ctx, keepAliveCountKey{}, n)
+}
+
+// keepAliveCount is the number of keep-alive requests served on the
+// connection before this one, like Apache's %k. It is only available
+// if the server uses a ConnTracker
+var keepAliveCount = newField(func(ctx LogCtx) Value {
+	n, ok := ctx.Request().Context().Value(keepAliveCountKey{}).(int64)
+	if !ok {
+		return MissingValue()
+	}
+	return IntValue(n)
+})
+
+// hijackRecorder is implemented by LogCtx values that know if the
+// connection was hijacked. The LogCtx used by ApacheLog.Wrap
+// implements it
+type hijackRecorder interface {
+	Hijacked() bool
+}
+
+// abortRecorder is implemented by LogCtx values that know if the
+// client went away before the response was completed. The LogCtx used
+// by ApacheLog.Wrap implements it
+type abortRecorder interface {
+	Aborted() bool
+}
+
+// connectionStatus is the status of the connection when the response
+// is completed, like Apache's %X: "X" if the client went away before
+// the response was completed, "+" if the connection may be kept alive,
+// and "-" if it will be closed
+var connectionStatus = newField(func(ctx LogCtx) Value {
+	if hr, ok := ctx.(hijackRecorder); ok && hr.Hijacked() {
+		return StringValue("-")
+	}
+
+	r := ctx.Request()
+	var aborted bool
+	if ar, ok := ctx.(abortRecorder); ok {
+		aborted = ar.Aborted()
+	} else {
+		aborted = requestAborted(r)
+	}
+	if aborted {
+		return StringValue("X")
+	}
+	if !keepAlive(r, ctx.ResponseHeader()) {
+		return StringValue("-")
+	}
+	return StringValue("+")
+})
+
+// keepAlive reports if the connection may be reused after responding
+// to r with the headers h
+func keepAlive(r *http.Request, h http.Header) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	if r.Close || headerHasToken(h, "Connection", "close") {
+		return false
+	}
+	if r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		return headerHasToken(r.Header, "Connection", "keep-alive")
+	}
+	return true
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
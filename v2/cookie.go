@@ -0,0 +1,82 @@
+package apachelog
+
+import (
+	"net/http"
+	"strings"
+)
+
+// setCookiePrefix selects the Set-Cookie response headers in
+// %{set:NAME}C, instead of the Cookie request header
+const setCookiePrefix = "set:"
+
+func makeCookie(key string) Field {
+	if strings.HasPrefix(key, setCookiePrefix) {
+		return responseCookie(strings.TrimPrefix(key, setCookiePrefix))
+	}
+	return requestCookie(key)
+}
+
+// requestCookie is the value of a cookie sent by the client. If the
+// cookie appears more than once, the first value is used, like
+// Apache and http.Request.Cookie. Malformed parts of the Cookie
+// headers are skipped
+type requestCookie string
+
+func (c requestCookie) Extract(ctx LogCtx) Value {
+	for _, line := range ctx.Request().Header["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			if v, ok := cookieValue(part, string(c)); ok {
+				return stringOrMissing(v)
+			}
+		}
+	}
+	return MissingValue()
+}
+
+// responseCookie is the value of a cookie set by the response. If the
+// cookie is set more than once, the last value is used, as that is the
+// one that the client ends up storing
+type responseCookie string
+
+func (c responseCookie) Extract(ctx LogCtx) Value {
+	var value string
+	var found bool
+	for _, line := range responseSetCookies(ctx) {
+		// Only the first part is the cookie, the rest are attributes
+		if i := strings.IndexByte(line, ';'); i > -1 {
+			line = line[:i]
+		}
+		if v, ok := cookieValue(line, string(c)); ok {
+			value, found = v, true
+		}
+	}
+	if !found {
+		return MissingValue()
+	}
+	return stringOrMissing(value)
+}
+
+func responseSetCookies(ctx LogCtx) []string {
+	h := ctx.ResponseHeader()
+	if h == nil {
+		return nil
+	}
+	return h[http.CanonicalHeaderKey("Set-Cookie")]
+}
+
+// cookieValue parses a single "name=value" pair, and returns the
+// value if the name matches. Surrounding quotes are removed from the
+// value
+func cookieValue(pair, name string) (string, bool) {
+	pair = strings.TrimSpace(pair)
+	i := strings.IndexByte(pair, '=')
+	if i < 0 || strings.TrimSpace(pair[:i]) != name {
+		return "", false
+	}
+
+	v := strings.TrimSpace(pair[i+1:])
+	if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return v, true
+}
@@ -0,0 +1,224 @@
+package apachelog
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// labeledFormat is a Format associated with a label, as used by the
+// structured encoders
+type labeledFormat struct {
+	label  string
+	format *Format
+}
+
+// compileLabeled compiles the formats in fields, sorted by their
+// labels. Each label is checked using validate, if given. The formats
+// are compiled without escaping, as each encoder applies its own rules
+func compileLabeled(encoding string, fields map[string]string, options []Option, validate func(string) error) ([]labeledFormat, error) {
+	labels := make([]string, 0, len(fields))
+	for label := range fields {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	// Use a full slice expression so that the caller's slice is never
+	// modified, even if it has spare capacity
+	options = append(options[:len(options):len(options)], WithEscape(false))
+
+	compiled := make([]labeledFormat, 0, len(labels))
+	for _, label := range labels {
+		if validate != nil {
+			if err := validate(label); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s label %s", encoding, strconv.Quote(label))
+			}
+		}
+
+		f, err := newFormat(fields[label], options)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create format for %s field %s", encoding, strconv.Quote(label))
+		}
+		compiled = append(compiled, labeledFormat{label: label, format: f})
+	}
+	return compiled, nil
+}
+
+// labeledWarnings collects the compile warnings of each format in fields
+func labeledWarnings(fields []labeledFormat) []*CompileError {
+	var warnings []*CompileError
+	for _, field := range fields {
+		warnings = append(warnings, field.format.Warnings()...)
+	}
+	return warnings
+}
+
+// labeledNeeds collects the per-request state logged by the formats in
+// fields
+func labeledNeeds(fields []labeledFormat) need {
+	var needs need
+	for _, field := range fields {
+		needs |= field.format.needs
+	}
+	return needs
+}
+
+// ltsvEncoder writes log lines in LTSV (Labeled Tab-separated Values)
+// format. See http://ltsv.org
+type ltsvEncoder struct {
+	fields []labeledFormat
+}
+
+// NewLTSV creates a new ApacheLog instance that writes each log line
+// in LTSV format. The keys of fields are used as labels, and the values
+// are formats that use the same syntax as New.
+//
+//	al, err := apachelog.NewLTSV(map[string]string{
+//	  "host":   "%h",
+//	  "status": "%>s",
+//	  "ua":     "%{User-Agent}i",
+//	})
+//
+// Labels may only contain alphanumeric characters, '_', '.', and '-'.
+// Tabs, newlines and backslashes in values are escaped with a
+// backslash. Labels are written in lexical order.
+func NewLTSV(fields map[string]string, options ...Option) (*ApacheLog, error) {
+	compiled, err := compileLabeled("LTSV", fields, options, validateLTSVLabel)
+	if err != nil {
+		return nil, err
+	}
+	return newApacheLog(&ltsvEncoder{fields: compiled}, labeledWarnings(compiled), labeledNeeds(compiled), options), nil
+}
+
+func validateLTSVLabel(label string) error {
+	if label == "" {
+		return errors.New("label must not be empty")
+	}
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case c >= '0' && c <= '9', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c == '_', c == '.', c == '-':
+		default:
+			return errors.Errorf("invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+func appendLTSVValue(dst []byte, v string) []byte {
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func (enc *ltsvEncoder) WriteTo(dst io.Writer, ctx LogCtx) error {
+	buf := getLogBuffer()
+	defer releaseLogBuffer(buf)
+
+	var b []byte
+	for i, field := range enc.fields {
+		if i > 0 {
+			b = append(b, '\t')
+		}
+		b = append(b, field.label...)
+		b = append(b, ':')
+
+		buf.Reset()
+		if err := field.format.WriteTo(buf, ctx); err != nil {
+			return errors.Wrapf(err, "failed to compute value for LTSV field %s", strconv.Quote(field.label))
+		}
+		b = appendLTSVValue(b, buf.String())
+	}
+
+	if _, err := dst.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write LTSV record")
+	}
+	return nil
+}
+
+// logfmtEncoder writes log lines as space separated key=value pairs
+type logfmtEncoder struct {
+	fields []labeledFormat
+}
+
+// NewLogfmt creates a new ApacheLog instance that writes each log line
+// in logfmt format. The keys of fields are used as keys, and the values
+// are formats that use the same syntax as New.
+//
+//	al, err := apachelog.NewLogfmt(map[string]string{
+//	  "host":   "%h",
+//	  "status": "%>s",
+//	  "ua":     "%{User-Agent}i",
+//	})
+//
+// Keys must not be empty, and may not contain spaces, '=', '"', or
+// control characters. Values that contain any of those, or that are
+// empty, are double quoted. Keys are written in lexical order.
+func NewLogfmt(fields map[string]string, options ...Option) (*ApacheLog, error) {
+	compiled, err := compileLabeled("logfmt", fields, options, validateLogfmtKey)
+	if err != nil {
+		return nil, err
+	}
+	return newApacheLog(&logfmtEncoder{fields: compiled}, labeledWarnings(compiled), labeledNeeds(compiled), options), nil
+}
+
+func validateLogfmtKey(key string) error {
+	if key == "" {
+		return errors.New("key must not be empty")
+	}
+	if i := strings.IndexFunc(key, logfmtNeedsQuote); i > -1 {
+		return errors.Errorf("invalid character %q", key[i])
+	}
+	return nil
+}
+
+func logfmtNeedsQuote(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+}
+
+func appendLogfmtValue(dst []byte, v string) []byte {
+	if v != "" && strings.IndexFunc(v, logfmtNeedsQuote) < 0 && !strings.ContainsRune(v, '\\') {
+		return append(dst, v...)
+	}
+	return strconv.AppendQuote(dst, v)
+}
+
+func (enc *logfmtEncoder) WriteTo(dst io.Writer, ctx LogCtx) error {
+	buf := getLogBuffer()
+	defer releaseLogBuffer(buf)
+
+	var b []byte
+	for i, field := range enc.fields {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, field.label...)
+		b = append(b, '=')
+
+		buf.Reset()
+		if err := field.format.WriteTo(buf, ctx); err != nil {
+			return errors.Wrapf(err, "failed to compute value for logfmt field %s", strconv.Quote(field.label))
+		}
+		b = appendLogfmtValue(b, buf.String())
+	}
+
+	if _, err := dst.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write logfmt record")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package apachelog
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Entry is a LogCtx that is filled in by hand. It can be used to log
+// traffic that does not go through an http.Handler, such as requests
+// handled by a proxy or replayed from a queue
+//
+//	e := apachelog.NewEntry(r).
+//	  Status(http.StatusOK).
+//	  Bytes(n).
+//	  Times(start, end).
+//	  Header(resHeader)
+//	apachelog.CombinedLog.WriteLog(os.Stdout, e)
+//
+// An Entry is not safe to use from multiple goroutines while it is
+// being filled in
+type Entry struct {
+	bytesReceived int64
+	bytesSent     int64
+	contentLength int64
+	header        http.Header
+	request       *http.Request
+	requestTime   time.Time
+	responseTime  time.Time
+	status        int
+	trailer       http.Header
+}
+
+// NewEntry creates a new Entry for the request r. If r is nil, an
+// empty request is used: the request method, protocol and path (%m,
+// %H and %U) are logged as empty strings, and the other directives
+// that depend on it, such as %r and headers, as missing values
+func NewEntry(r *http.Request) *Entry {
+	if r == nil {
+		r = &http.Request{
+			Header: http.Header{},
+			URL:    &url.URL{},
+		}
+	}
+	return &Entry{request: r}
+}
+
+// Status sets the status code of the response
+func (e *Entry) Status(code int) *Entry {
+	e.status = code
+	return e
+}
+
+// Bytes sets the size of the response body
+func (e *Entry) Bytes(n int64) *Entry {
+	e.contentLength = n
+	return e
+}
+
+// Transferred sets the number of bytes received for the request and
+// sent for the response, including headers, as logged by %I, %O and
+// %S. If they are not set, they are estimated from the headers
+func (e *Entry) Transferred(received, sent int64) *Entry {
+	e.bytesReceived = received
+	e.bytesSent = sent
+	return e
+}
+
+// Times sets the time when the request was received, and the time when
+// the response was completed. The elapsed time is the difference
+// between the two
+func (e *Entry) Times(start, end time.Time) *Entry {
+	e.requestTime = start
+	e.responseTime = end
+	return e
+}
+
+// Header sets the headers of the response
+func (e *Entry) Header(h http.Header) *Entry {
+	e.header = h
+	return e
+}
+
+// Trailer sets the trailers sent after the response body
+func (e *Entry) Trailer(h http.Header) *Entry {
+	e.trailer = h
+	return e
+}
+
+// BytesReceived returns the number of bytes received for the request,
+// as set via Transferred
+func (e *Entry) BytesReceived() int64 {
+	return e.bytesReceived
+}
+
+// BytesSent returns the number of bytes sent for the response, as set
+// via Transferred
+func (e *Entry) BytesSent() int64 {
+	return e.bytesSent
+}
+
+func (e *Entry) ElapsedTime() time.Duration {
+	return e.responseTime.Sub(e.requestTime)
+}
+
+func (e *Entry) Request() *http.Request {
+	return e.request
+}
+
+func (e *Entry) RequestTime() time.Time {
+	return e.requestTime
+}
+
+func (e *Entry) ResponseContentLength() int64 {
+	return e.contentLength
+}
+
+func (e *Entry) ResponseHeader() http.Header {
+	return e.header
+}
+
+func (e *Entry) ResponseStatus() int {
+	return e.status
+}
+
+// ResponseTrailer returns the trailers set via Trailer
+func (e *Entry) ResponseTrailer() http.Header {
+	return e.trailer
+}
+
+func (e *Entry) ResponseTime() time.Time {
+	return e.responseTime
+}
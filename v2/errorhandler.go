@@ -0,0 +1,70 @@
+package apachelog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitedErrorHandler writes errors that occur while logging
+// requests to an io.Writer, at most once per interval. Errors that
+// occur in between are counted, and the number of suppressed errors
+// is reported along with the next error that is written.
+//
+// A RateLimitedErrorHandler writing to os.Stderr once per second is
+// used by default. Use WithErrorHandler to change it
+type RateLimitedErrorHandler struct {
+	dst      io.Writer
+	interval time.Duration
+
+	mu         sync.Mutex
+	count      uint64
+	last       time.Time
+	suppressed uint64
+}
+
+// NewRateLimitedErrorHandler creates a new RateLimitedErrorHandler
+// that writes to dst, at most once per interval
+func NewRateLimitedErrorHandler(dst io.Writer, interval time.Duration) *RateLimitedErrorHandler {
+	return &RateLimitedErrorHandler{
+		dst:      dst,
+		interval: interval,
+	}
+}
+
+// Handle records err, and writes it to the destination unless another
+// error was written less than the configured interval ago. It can be
+// passed to WithErrorHandler
+func (h *RateLimitedErrorHandler) Handle(err error, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	now := time.Now()
+	if !h.last.IsZero() && now.Sub(h.last) < h.interval {
+		h.suppressed++
+		return
+	}
+	h.last = now
+
+	var target string
+	if r != nil && r.URL != nil {
+		target = fmt.Sprintf(" for %s %s", r.Method, r.URL.RequestURI())
+	}
+	var suffix string
+	if h.suppressed > 0 {
+		suffix = fmt.Sprintf(" (%d similar errors suppressed)", h.suppressed)
+		h.suppressed = 0
+	}
+	fmt.Fprintf(h.dst, "apachelog: failed to write log line%s: %s%s\n", target, err, suffix)
+}
+
+// Count returns the total number of errors that were handled,
+// including those that were not written
+func (h *RateLimitedErrorHandler) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
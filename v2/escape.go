@@ -0,0 +1,96 @@
+package apachelog
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// needsEscape reports if c must be escaped in a log line. This follows
+// Apache's ap_escape_logitem: double quotes, backslashes, and anything
+// that is not a printable ASCII character are escaped
+func needsEscape(c byte) bool {
+	return c < 0x20 || c > 0x7e || c == '"' || c == '\\'
+}
+
+// appendEscaped appends src to dst, escaping characters the same way
+// Apache does when writing values to its logs.
+func appendEscaped(dst []byte, src string) []byte {
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if !needsEscape(c) {
+			dst = append(dst, c)
+			continue
+		}
+
+		switch c {
+		case '"', '\\':
+			dst = append(dst, '\\', c)
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\v':
+			dst = append(dst, '\\', 'v')
+		default:
+			dst = append(dst, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		}
+	}
+	return dst
+}
+
+// unescape reverses the escaping performed by appendEscaped
+func unescape(s string) (string, error) {
+	i := strings.IndexByte(s, '\\')
+	if i < 0 {
+		return s, nil
+	}
+
+	b := make([]byte, 0, len(s))
+	b = append(b, s[:i]...)
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			return "", errors.New("incomplete escape sequence at end of value")
+		}
+
+		switch c = s[i]; c {
+		case 'b':
+			b = append(b, '\b')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'v':
+			b = append(b, '\v')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", errors.New("incomplete hex escape sequence")
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.Wrap(err, "invalid hex escape sequence")
+			}
+			b = append(b, byte(v))
+			i += 2
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b), nil
+}
@@ -0,0 +1,254 @@
+package apachelog
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kind describes the type of a Value
+type Kind int
+
+const (
+	// KindMissing is the kind of a Value that is not available, such
+	// as a request header that was not sent. It is usually written
+	// as "-" in text formats, and as null in JSON
+	KindMissing Kind = iota
+	KindString
+	KindInt
+	KindTime
+	KindDuration
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindMissing:
+		return "missing"
+	case KindString:
+		return "string"
+	case KindInt:
+		return "int"
+	case KindTime:
+		return "time"
+	case KindDuration:
+		return "duration"
+	}
+	return "Kind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Value is the typed value of a directive, extracted from a LogCtx.
+// The zero value is a missing value
+type Value struct {
+	kind Kind
+	str  string
+	num  int64
+	time time.Time
+}
+
+// MissingValue returns a Value that represents a missing value
+func MissingValue() Value {
+	return Value{}
+}
+
+// StringValue returns a Value containing a string
+func StringValue(s string) Value {
+	return Value{kind: KindString, str: s}
+}
+
+// IntValue returns a Value containing an integer
+func IntValue(n int64) Value {
+	return Value{kind: KindInt, num: n}
+}
+
+// TimeValue returns a Value containing a point in time
+func TimeValue(t time.Time) Value {
+	return Value{kind: KindTime, time: t}
+}
+
+// DurationValue returns a Value containing a duration
+func DurationValue(d time.Duration) Value {
+	return Value{kind: KindDuration, num: int64(d)}
+}
+
+// stringOrMissing returns a string Value, or a missing Value if s is empty
+func stringOrMissing(s string) Value {
+	if s == "" {
+		return MissingValue()
+	}
+	return StringValue(s)
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+func (v Value) IsMissing() bool {
+	return v.kind == KindMissing
+}
+
+// Int returns the integer contained in v. It returns 0 if v
+// is not of KindInt
+func (v Value) Int() int64 {
+	if v.kind != KindInt {
+		return 0
+	}
+	return v.num
+}
+
+// Time returns the time contained in v. It returns the zero time
+// if v is not of KindTime
+func (v Value) Time() time.Time {
+	return v.time
+}
+
+// Duration returns the duration contained in v. It returns 0 if v
+// is not of KindDuration
+func (v Value) Duration() time.Duration {
+	if v.kind != KindDuration {
+		return 0
+	}
+	return time.Duration(v.num)
+}
+
+// String returns a textual representation of v. Strings are returned
+// as is, integers in decimal, times in RFC 3339 format, and durations
+// in the format used by time.Duration. Missing values are returned
+// as "-".
+func (v Value) String() string {
+	return string(v.appendText(nil))
+}
+
+func (v Value) appendText(dst []byte) []byte {
+	switch v.kind {
+	case KindString:
+		return append(dst, v.str...)
+	case KindInt:
+		return strconv.AppendInt(dst, v.num, 10)
+	case KindTime:
+		return v.time.AppendFormat(dst, time.RFC3339)
+	case KindDuration:
+		return append(dst, time.Duration(v.num).String()...)
+	}
+	return append(dst, dashValue...)
+}
+
+// Field is implemented by directives that can extract a typed value
+// from a LogCtx. All built-in directives implement Field, and the
+// text format, as well as the other encoders, are rendered from the
+// values that they extract.
+type Field interface {
+	Extract(LogCtx) Value
+}
+
+// FieldFunc is a function that implements Field
+type FieldFunc func(LogCtx) Value
+
+func (f FieldFunc) Extract(ctx LogCtx) Value {
+	return f(ctx)
+}
+
+// FieldValue is the value of a single directive in a Format
+type FieldValue struct {
+	// Directive is the directive as it was written in the format,
+	// e.g. "%h" or "%{Referer}i"
+	Directive string
+	Value     Value
+}
+
+// textAppender is implemented by fields that require a specific
+// text representation, such as times and durations
+type textAppender interface {
+	appendText([]byte, Value) []byte
+}
+
+// blankMissing is implemented by fields that render missing values as
+// an empty string instead of a dash
+type blankMissing interface {
+	blankWhenMissing() bool
+}
+
+// builtinField is the Field implementation used by most of the
+// built-in directives
+type builtinField struct {
+	extract func(LogCtx) Value
+	text    func([]byte, Value) []byte
+	blank   bool
+}
+
+func newField(fn func(LogCtx) Value) *builtinField {
+	return &builtinField{extract: fn}
+}
+
+// newBlankField creates a field that renders missing values as an
+// empty string
+func newBlankField(fn func(LogCtx) Value) *builtinField {
+	return &builtinField{extract: fn, blank: true}
+}
+
+func newTextField(fn func(LogCtx) Value, text func([]byte, Value) []byte) *builtinField {
+	return &builtinField{extract: fn, text: text}
+}
+
+func (f *builtinField) Extract(ctx LogCtx) Value {
+	return f.extract(ctx)
+}
+
+func (f *builtinField) appendText(dst []byte, v Value) []byte {
+	if f.text == nil {
+		return v.appendText(dst)
+	}
+	return f.text(dst, v)
+}
+
+func (f *builtinField) blankWhenMissing() bool {
+	return f.blank
+}
+
+func (f *builtinField) WriteTo(dst io.Writer, ctx LogCtx) error {
+	return writeField(dst, f, ctx)
+}
+
+var defaultFormat Format
+
+// writeField writes the value of fld using the default text format
+func writeField(dst io.Writer, fld Field, ctx LogCtx) error {
+	buf := getLogBuffer()
+	defer releaseLogBuffer(buf)
+
+	b := defaultFormat.appendValue(buf.Bytes(), fld, fld.Extract(ctx))
+	if _, err := dst.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write field value")
+	}
+	return nil
+}
+
+// appendValue appends the text representation of v, which was
+// extracted from fld, to dst
+func (f *Format) appendValue(dst []byte, fld Field, v Value) []byte {
+	switch v.kind {
+	case KindMissing:
+		if bm, ok := fld.(blankMissing); ok && bm.blankWhenMissing() {
+			return dst
+		}
+		if f.missing != nil {
+			return append(dst, f.missing...)
+		}
+		return append(dst, dashValue...)
+	case KindString:
+		if f.noEscape {
+			return append(dst, v.str...)
+		}
+		return appendEscaped(dst, v.str)
+	case KindTime:
+		if f.location != nil {
+			v.time = v.time.In(f.location)
+		}
+	}
+
+	if ta, ok := fld.(textAppender); ok {
+		return ta.appendText(dst, v)
+	}
+	return v.appendText(dst)
+}
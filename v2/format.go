@@ -3,6 +3,7 @@ package apachelog
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -18,17 +19,13 @@ func (f FormatWriteFunc) WriteTo(dst io.Writer, ctx LogCtx) error {
 }
 
 var dashValue = []byte{'-'}
-var emptyValue = []byte(nil)
-
-func valueOf(s string, replacement []byte) []byte {
-	if s == "" {
-		return replacement
-	}
-	return []byte(s)
-}
 
 type fixedByteSequence []byte
 
+func (seq fixedByteSequence) Extract(_ LogCtx) Value {
+	return StringValue(string(seq))
+}
+
 func (seq fixedByteSequence) WriteTo(dst io.Writer, _ LogCtx) error {
 	if _, err := dst.Write([]byte(seq)); err != nil {
 		return errors.Wrapf(err, "failed to write fixed byte sequence %s", seq)
@@ -38,47 +35,70 @@ func (seq fixedByteSequence) WriteTo(dst io.Writer, _ LogCtx) error {
 
 type requestHeader string
 
+func (h requestHeader) Extract(ctx LogCtx) Value {
+	return stringOrMissing(ctx.Request().Header.Get(string(h)))
+}
+
 func (h requestHeader) WriteTo(dst io.Writer, ctx LogCtx) error {
-	v := ctx.Request().Header.Get(string(h))
-	if _, err := dst.Write(valueOf(v, dashValue)); err != nil {
-		return errors.Wrap(err, "failed to write request header value")
-	}
-	return nil
+	return writeField(dst, h, ctx)
 }
 
 type responseHeader string
 
+func (h responseHeader) Extract(ctx LogCtx) Value {
+	return stringOrMissing(ctx.ResponseHeader().Get(string(h)))
+}
+
 func (h responseHeader) WriteTo(dst io.Writer, ctx LogCtx) error {
-	v := ctx.ResponseHeader().Get(string(h))
-	if _, err := dst.Write(valueOf(v, dashValue)); err != nil {
-		return errors.Wrap(err, "failed to write response header value")
-	}
-	return nil
+	return writeField(dst, h, ctx)
 }
 
-func makeRequestTimeBegin(s string) (FormatWriter, error) {
-	f, err := strftime.New(s)
-	if err != nil {
-		return nil, errors.Wrap(err, `failed to compile strftime pattern`)
-	}
+// requestTrailer is the value of a trailer sent after the request
+// body. It is only available if the handler read the whole body
+type requestTrailer string
+
+func (h requestTrailer) Extract(ctx LogCtx) Value {
+	return stringOrMissing(ctx.Request().Trailer.Get(string(h)))
+}
+
+// trailerRecorder is implemented by LogCtx values that know the
+// trailers sent after the response body. The LogCtx used by
+// ApacheLog.Wrap, as well as Entry, implement it
+type trailerRecorder interface {
+	ResponseTrailer() http.Header
+}
 
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-		return f.Format(dst, ctx.RequestTime())
-	}), nil
+type responseTrailer string
+
+func (h responseTrailer) Extract(ctx LogCtx) Value {
+	tr, ok := ctx.(trailerRecorder)
+	if !ok {
+		return MissingValue()
+	}
+	return stringOrMissing(tr.ResponseTrailer().Get(string(h)))
 }
 
-func makeRequestTimeEnd(s string) (FormatWriter, error) {
+func makeStrftime(s string, end bool) (*builtinField, error) {
 	f, err := strftime.New(s)
 	if err != nil {
 		return nil, errors.Wrap(err, `failed to compile strftime pattern`)
 	}
 
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-		return f.Format(dst, ctx.ResponseTime())
-	}), nil
+	extract := LogCtx.RequestTime
+	if end {
+		extract = LogCtx.ResponseTime
+	}
+	return newTextField(
+		func(ctx LogCtx) Value {
+			return TimeValue(extract(ctx))
+		},
+		func(dst []byte, v Value) []byte {
+			return append(dst, f.FormatString(v.Time())...)
+		},
+	), nil
 }
 
-func elapsedFormatter(key string) (FormatWriter, error) {
+func elapsedFormatter(key string) (*builtinField, error) {
 	switch key {
 	case "ms":
 		return elapsedTimeMilliSeconds, nil
@@ -91,91 +111,66 @@ func elapsedFormatter(key string) (FormatWriter, error) {
 	}
 }
 
-func timeFormatter(key string) (FormatWriter, error) {
-	var formatter FormatWriter
+func timeFormatter(key string) (*builtinField, error) {
 	switch key {
 	case "sec":
-		formatter = requestTimeSecondsSinceEpoch
+		return requestTimeSecondsSinceEpoch, nil
 	case "msec":
-		formatter = requestTimeMillisecondsSinceEpoch
+		return requestTimeMillisecondsSinceEpoch, nil
 	case "usec":
-		formatter = requestTimeMicrosecondsSinceEpoch
+		return requestTimeMicrosecondsSinceEpoch, nil
 	case "msec_frac":
-		formatter = requestTimeMillisecondsFracSinceEpoch
+		return requestTimeMillisecondsFracSinceEpoch, nil
 	case "usec_frac":
-		formatter = requestTimeMicrosecondsFracSinceEpoch
-	default:
-		const beginPrefix = "begin:"
-		const endPrefix = "end:"
-		if strings.HasPrefix(key, beginPrefix) {
-			return makeRequestTimeBegin(key[len(beginPrefix):])
-		} else if strings.HasPrefix(key, endPrefix) {
-			return makeRequestTimeEnd(key[len(endPrefix):])
-		}
-		// if specify the format of strftime(3) without begin: or end:, same as bigin:
-		// FYI https://httpd.apache.org/docs/current/en/mod/mod_log_config.html
-		return makeRequestTimeBegin(key)
+		return requestTimeMicrosecondsFracSinceEpoch, nil
+	}
+
+	const beginPrefix = "begin:"
+	const endPrefix = "end:"
+	if strings.HasPrefix(key, beginPrefix) {
+		return makeStrftime(key[len(beginPrefix):], false)
+	} else if strings.HasPrefix(key, endPrefix) {
+		return makeStrftime(key[len(endPrefix):], true)
 	}
-	return formatter, nil
+	// if specify the format of strftime(3) without begin: or end:, same as bigin:
+	// FYI https://httpd.apache.org/docs/current/en/mod/mod_log_config.html
+	return makeStrftime(key, false)
 }
 
 var epoch = time.Unix(0, 0)
 
-func makeRequestTimeSinceEpoch(base time.Duration) FormatWriter {
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
+func makeRequestTimeSinceEpoch(base time.Duration) *builtinField {
+	return newField(func(ctx LogCtx) Value {
 		dur := ctx.RequestTime().Sub(epoch)
-		s := strconv.FormatInt(dur.Nanoseconds()/int64(base), 10)
-		if _, err := dst.Write(valueOf(s, dashValue)); err != nil {
-			return errors.Wrap(err, `failed to write request time since epoch`)
-		}
-		return nil
+		return IntValue(dur.Nanoseconds() / int64(base))
 	})
 }
 
-func makeRequestTimeFracSinceEpoch(base time.Duration) FormatWriter {
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
+func makeRequestTimeFracSinceEpoch(base time.Duration) *builtinField {
+	return newField(func(ctx LogCtx) Value {
 		dur := ctx.RequestTime().Sub(epoch)
-
-		s := fmt.Sprintf("%g", float64(dur.Nanoseconds()%int64(base*1000))/float64(base))
-		if _, err := dst.Write(valueOf(s, dashValue)); err != nil {
-			return errors.Wrap(err, `failed to write request time since epoch`)
-		}
-		return nil
+		return StringValue(fmt.Sprintf("%g", float64(dur.Nanoseconds()%int64(base*1000))/float64(base)))
 	})
 }
 
-func makeElapsedTime(base time.Duration, fraction int) FormatWriter {
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-		var str string
-		if elapsed := ctx.ElapsedTime(); elapsed > 0 {
-			switch fraction {
-			case timeNotFraction:
-				str = strconv.Itoa(int(elapsed / base))
-			case timeMicroFraction:
-				str = fmt.Sprintf("%03d", int((elapsed%time.Millisecond)/base))
-			case timeMilliFraction:
-				str = fmt.Sprintf("%03d", int((elapsed%time.Second)/base))
-			default:
-				return errors.New("failed to write elapsed time")
+func makeElapsedTime(base time.Duration) *builtinField {
+	return newTextField(
+		func(ctx LogCtx) Value {
+			if elapsed := ctx.ElapsedTime(); elapsed > 0 {
+				return DurationValue(elapsed)
 			}
-		}
-		if _, err := dst.Write(valueOf(str, dashValue)); err != nil {
-			return errors.Wrap(err, "failed to write elapsed time")
-		}
-		return nil
-	})
+			return MissingValue()
+		},
+		func(dst []byte, v Value) []byte {
+			return strconv.AppendInt(dst, int64(v.Duration()/base), 10)
+		},
+	)
 }
 
-const (
-	timeNotFraction = iota
-	timeMicroFraction
-	timeMilliFraction
-)
-
 var (
-	elapsedTimeMicroSeconds               = makeElapsedTime(time.Microsecond, timeNotFraction)
-	elapsedTimeMilliSeconds               = makeElapsedTime(time.Millisecond, timeNotFraction)
-	elapsedTimeSeconds                    = makeElapsedTime(time.Second, timeNotFraction)
+	elapsedTimeMicroSeconds               = makeElapsedTime(time.Microsecond)
+	elapsedTimeMilliSeconds               = makeElapsedTime(time.Millisecond)
+	elapsedTimeSeconds                    = makeElapsedTime(time.Second)
 	requestTimeMicrosecondsFracSinceEpoch = makeRequestTimeFracSinceEpoch(time.Microsecond)
 	requestTimeMillisecondsFracSinceEpoch = makeRequestTimeFracSinceEpoch(time.Millisecond)
 	requestTimeSecondsSinceEpoch          = makeRequestTimeSinceEpoch(time.Second)
@@ -183,140 +178,488 @@ var (
 	requestTimeMicrosecondsSinceEpoch     = makeRequestTimeSinceEpoch(time.Microsecond)
 )
 
-var requestHttpMethod = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	v := valueOf(ctx.Request().Method, emptyValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request method")
-	}
-	return nil
+// remoteLogname is always missing, as we don't support identd
+var remoteLogname = newField(func(LogCtx) Value {
+	return MissingValue()
 })
 
-var requestHttpProto = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	v := valueOf(ctx.Request().Proto, emptyValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request HTTP request proto")
-	}
-	return nil
+var requestHttpMethod = newField(func(ctx LogCtx) Value {
+	return StringValue(ctx.Request().Method)
+})
+
+var requestHttpProto = newField(func(ctx LogCtx) Value {
+	return StringValue(ctx.Request().Proto)
 })
 
-var requestRemoteAddr = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
+var requestRemoteAddr = newField(func(ctx LogCtx) Value {
 	addr := ctx.Request().RemoteAddr
 	if i := strings.LastIndexByte(addr, ':'); i > -1 {
 		addr = addr[:i]
 	}
-	v := valueOf(addr, dashValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request remote address")
-	}
-	return nil
+	return stringOrMissing(addr)
 })
 
-var pid = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	v := valueOf(strconv.Itoa(os.Getpid()), emptyValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write pid")
-	}
-	return nil
+var pid = newField(func(ctx LogCtx) Value {
+	return IntValue(int64(os.Getpid()))
 })
 
-var rawQuery = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
+func makeThreadID(base int) *builtinField {
+	return newTextField(
+		func(ctx LogCtx) Value {
+			if tid, ok := gettid(); ok {
+				return IntValue(int64(tid))
+			}
+			return MissingValue()
+		},
+		func(dst []byte, v Value) []byte {
+			return strconv.AppendInt(dst, v.Int(), base)
+		},
+	)
+}
+
+var (
+	threadID    = makeThreadID(10)
+	hexThreadID = makeThreadID(16)
+)
+
+var rawQuery = newField(func(ctx LogCtx) Value {
 	q := ctx.Request().URL.RawQuery
 	if q != "" {
 		q = "?" + q
 	}
-	v := valueOf(q, emptyValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write raw request query")
-	}
-	return nil
+	return StringValue(q)
 })
 
-var requestLine = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	buf := getLogBuffer()
-	defer releaseLogBuffer(buf)
-
+var requestLine = newField(func(ctx LogCtx) Value {
 	r := ctx.Request()
-	buf.WriteString(r.Method)
-	buf.WriteByte(' ')
-	buf.WriteString(r.URL.String())
-	buf.WriteByte(' ')
-	buf.WriteString(r.Proto)
-	if _, err := buf.WriteTo(dst); err != nil {
-		return errors.Wrap(err, "failed to write request line")
+	if r.Method == "" && r.Proto == "" { // e.g. the empty request of an Entry
+		return MissingValue()
 	}
-	return nil
+	return StringValue(r.Method + " " + r.URL.String() + " " + r.Proto)
 })
 
-var httpStatus = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	var s string
+var httpStatus = newBlankField(func(ctx LogCtx) Value {
 	if st := ctx.ResponseStatus(); st != 0 { // can't really happen, but why not
-		s = strconv.Itoa(st)
-	}
-	if _, err := dst.Write(valueOf(s, emptyValue)); err != nil {
-		return errors.Wrap(err, "failed to write response status")
+		return IntValue(int64(st))
 	}
-	return nil
+	return MissingValue()
 })
 
-var requestTime = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	v := valueOf(ctx.RequestTime().Format("[02/Jan/2006:15:04:05 -0700]"), []byte{'[', ']'})
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request time")
+// statusRecorder is implemented by LogCtx values that know the
+// history of the status of the response. The LogCtx used by
+// ApacheLog.Wrap implements it
+type statusRecorder interface {
+	// OriginalResponseStatus returns the first status written
+	OriginalResponseStatus() int
+	// InformationalResponseStatuses returns the 1xx statuses that were
+	// written before the final status, such as 103 Early Hints
+	InformationalResponseStatuses() []int
+	// SuperfluousResponseStatuses returns the statuses written after
+	// the status was sent, e.g. by a middleware that tried to rewrite
+	// it. net/http ignores them
+	SuperfluousResponseStatuses() []int
+}
+
+// originalHttpStatus is the status first written by the handler. As
+// net/http only sends the first status, it is the same as httpStatus
+// for the requests logged by ApacheLog.Wrap, as well as when the LogCtx
+// does not record it. Later attempts to change the status are logged
+// by %{superfluous}s
+var originalHttpStatus = newBlankField(func(ctx LogCtx) Value {
+	if sr, ok := ctx.(statusRecorder); ok {
+		if st := sr.OriginalResponseStatus(); st != 0 {
+			return IntValue(int64(st))
+		}
 	}
-	return nil
+	return httpStatus.Extract(ctx)
 })
 
-var urlPath = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	v := valueOf(ctx.Request().URL.Path, emptyValue)
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request URL path")
+// makeStatusList creates a field that logs a comma separated list of
+// the statuses returned by list
+func makeStatusList(list func(statusRecorder) []int) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		sr, ok := ctx.(statusRecorder)
+		if !ok {
+			return MissingValue()
+		}
+		return statusListValue(list(sr))
+	})
+}
+
+var (
+	informationalHttpStatuses = makeStatusList(statusRecorder.InformationalResponseStatuses)
+	superfluousHttpStatuses   = makeStatusList(statusRecorder.SuperfluousResponseStatuses)
+)
+
+func statusListValue(statuses []int) Value {
+	if len(statuses) == 0 {
+		return MissingValue()
 	}
-	return nil
+
+	b := make([]byte, 0, 4*len(statuses))
+	for i, st := range statuses {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(st), 10)
+	}
+	return StringValue(string(b))
+}
+
+const clfTimeLayout = "[02/Jan/2006:15:04:05 -0700]"
+
+var requestTime = newTextField(
+	func(ctx LogCtx) Value {
+		return TimeValue(ctx.RequestTime())
+	},
+	func(dst []byte, v Value) []byte {
+		return v.Time().AppendFormat(dst, clfTimeLayout)
+	},
+)
+
+var urlPath = newField(func(ctx LogCtx) Value {
+	return StringValue(ctx.Request().URL.Path)
 })
 
-var username = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	var v = dashValue
+var username = newField(func(ctx LogCtx) Value {
 	if u := ctx.Request().URL.User; u != nil {
-		v = valueOf(u.Username(), dashValue)
+		return stringOrMissing(u.Username())
 	}
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write username")
-	}
-	return nil
+	return MissingValue()
 })
 
-var requestHost = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	var v []byte
+var requestHost = newField(func(ctx LogCtx) Value {
 	h := ctx.Request().Host
-	if strings.IndexByte(h, ':') > 0 {
-		v = valueOf(strings.Split(ctx.Request().Host, ":")[0], dashValue)
-	} else {
-		v = valueOf(h, dashValue)
-	}
-	if _, err := dst.Write(v); err != nil {
-		return errors.Wrap(err, "failed to write request host")
+	if i := strings.IndexByte(h, ':'); i > 0 {
+		h = h[:i]
 	}
-	return nil
+	return stringOrMissing(h)
 })
 
-var responseContentLength = FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-	var s string
+var responseContentLength = newField(func(ctx LogCtx) Value {
 	if cl := ctx.ResponseContentLength(); cl != 0 {
-		s = strconv.FormatInt(cl, 10)
+		return IntValue(cl)
 	}
-	_, err := dst.Write(valueOf(s, dashValue))
-	return err
+	return MissingValue()
+})
+
+// responseContentLengthOrZero is the same as responseContentLength,
+// except that nothing being sent is logged as 0 instead of "-"
+var responseContentLengthOrZero = newField(func(ctx LogCtx) Value {
+	return IntValue(ctx.ResponseContentLength())
 })
 
-func makeEnvVar(key string) FormatWriter {
-	return FormatWriteFunc(func(dst io.Writer, ctx LogCtx) error {
-		_, err := dst.Write(valueOf(os.Getenv(key), dashValue))
-		return err
+func makeEnvVar(key string) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		return stringOrMissing(os.Getenv(key))
 	})
 }
 
+// directive is a single compiled element of a Format. Literal text
+// has an empty verb.
+type directive struct {
+	verb   string // e.g. "h", ">s", or the block type "i" in %{...}i
+	key    string // the contents of the %{...} block, if any
+	status string // the status condition, e.g. "400,501" or "!200", if any
+	field  Field
+}
+
+func (d directive) isLiteral() bool {
+	return d.verb == ""
+}
+
+// String returns the directive as it would appear in a format string.
+func (d directive) String() string {
+	if d.isLiteral() {
+		return string(d.field.(fixedByteSequence))
+	}
+	if d.key != "" {
+		return "%" + d.status + "{" + d.key + "}" + d.verb
+	}
+	return "%" + d.status + d.verb
+}
+
+// need is a set of the per-request state that a format logs, so that
+// ApacheLog.Wrap only sets up what is needed
+type need uint
+
+const (
+	needNotes          need = 1 << iota // %{...}n
+	needRequestID                       // %L and %{UNIQUE_ID}e
+	needTraceContext                    // the trace variants of %{...}x
+	needKeepAliveCount                  // %k
+	needRequestBody                     // %I and %S
+	needResponseHeader                  // %{...}o, %O, %S and %X
+	needTransferred                     // %I, %O and %S
+)
+
+// directiveNeeds returns the per-request state that the directive
+// made of verb and key logs
+func directiveNeeds(verb, key string) need {
+	switch verb {
+	case "n":
+		return needNotes
+	case "L":
+		return needRequestID
+	case "e":
+		if key == "UNIQUE_ID" {
+			return needRequestID
+		}
+	case "x":
+		for _, k := range traceKeys {
+			if k == key {
+				return needTraceContext
+			}
+		}
+	case "k":
+		return needKeepAliveCount
+	case "I":
+		return needRequestBody | needTransferred
+	case "O":
+		return needResponseHeader | needTransferred
+	case "S":
+		return needRequestBody | needResponseHeader | needTransferred
+	case "o", "X":
+		return needResponseHeader
+	}
+	return 0
+}
+
+// keylessVerbs are the verbs that do not take a key, such as %h. A key
+// given to them, as in %{Referer}I, is most likely a typo
+var keylessVerbs = map[string]bool{
+	"A": true, "b": true, "B": true, "D": true, "h": true, "H": true,
+	"I": true, "k": true, "l": true, "L": true, "m": true, "O": true,
+	"q": true, "r": true, ">s": true, "S": true, "u": true, "U": true,
+	"v": true, "V": true, "X": true,
+}
+
+// makeField returns the Field for the given verb and key. A nil
+// Field without an error means that the directive is silently ignored.
+func (f *Format) makeField(verb, key string) (Field, error) {
+	switch verb {
+	case "a":
+		switch key {
+		case "":
+			return makeClientIP(f.remoteIP), nil
+		case "c":
+			return peerIPAddr, nil
+		}
+		return nil, ErrUnimplemented
+	case "b":
+		return responseContentLength, nil
+	case "B":
+		return responseContentLengthOrZero, nil
+	case "C":
+		if key == "" {
+			return nil, ErrUnimplemented
+		}
+		return makeCookie(key), nil
+	case "D": // custom
+		return elapsedTimeMicroSeconds, nil
+	case "h":
+		return requestRemoteAddr, nil
+	case "H":
+		return requestHttpProto, nil
+	case "I": // mod_logio
+		return requestBytesReceived, nil
+	case "l":
+		return remoteLogname, nil
+	case "k":
+		return keepAliveCount, nil
+	case "L":
+		return requestIDField, nil
+	case "m":
+		return requestHttpMethod, nil
+	case "A":
+		return localIPAddr, nil
+	case "p":
+		switch key {
+		case "", "canonical":
+			return makeCanonicalPort(f.serverPort), nil
+		case "local":
+			return localPort, nil
+		case "remote":
+			return remotePort, nil
+		}
+		return nil, ErrUnimplemented
+	case "P":
+		switch key {
+		case "", "pid":
+			return pid, nil
+		case "tid":
+			return threadID, nil
+		case "hextid":
+			return hexThreadID, nil
+		}
+		return nil, ErrUnimplemented
+	case "O": // mod_logio
+		return responseBytesSent, nil
+	case "q":
+		return rawQuery, nil
+	case "r":
+		return requestLine, nil
+	case "s", "<s":
+		switch key {
+		case "":
+			return originalHttpStatus, nil
+		case "1xx":
+			return informationalHttpStatuses, nil
+		case "superfluous":
+			return superfluousHttpStatuses, nil
+		}
+		return nil, ErrUnimplemented
+	case "S": // mod_logio
+		return bytesTransferred, nil
+	case ">s":
+		return httpStatus, nil
+	case "t":
+		if key == "" {
+			return requestTime, nil
+		}
+		// The time, in the form given by format, which should be in an
+		// extended strftime(3) format (potentially localized). If the
+		// format starts with begin: (default) the time is taken at the
+		// beginning of the request processing. If it starts with end:
+		// it is the time when the log entry gets written, close to the
+		// end of the request processing. In addition to the formats
+		// supported by strftime(3), the following format tokens are
+		// supported:
+		//
+		// sec	number of seconds since the Epoch
+		// msec	number of milliseconds since the Epoch
+		// usec	number of microseconds since the Epoch
+		// msec_frac	millisecond fraction
+		// usec_frac	microsecond fraction
+		//
+		// These tokens can not be combined with each other or strftime(3)
+		// formatting in the same format string. You can use multiple
+		// %{format}t tokens instead.
+		return timeFormatter(key)
+	case "T": // custom
+		if key == "" {
+			return elapsedTimeSeconds, nil
+		}
+		return elapsedFormatter(key)
+	case "u":
+		return username, nil
+	case "U":
+		return urlPath, nil
+	case "V", "v":
+		return requestHost, nil
+	case "X":
+		return connectionStatus, nil
+	case "x":
+		for _, k := range traceKeys {
+			if k == key {
+				return makeTraceField(key), nil
+			}
+		}
+		for _, k := range tlsKeys {
+			if k == key {
+				return makeTLSField(key), nil
+			}
+		}
+		return nil, ErrUnimplemented
+	case "e": // environment variables
+		if key == "UNIQUE_ID" { // mod_unique_id
+			return requestIDField, nil
+		}
+		return makeEnvVar(key), nil
+	case "i":
+		return requestHeader(key), nil
+	case "n":
+		if key == "" {
+			return nil, ErrUnimplemented
+		}
+		return requestNote(key), nil
+	case "o":
+		return responseHeader(key), nil
+	case "^ti":
+		return requestTrailer(key), nil
+	case "^to":
+		return responseTrailer(key), nil
+	}
+
+	if key != "" {
+		return nil, ErrUnimplemented
+	}
+	// Unknown single character directives are ignored
+	return nil, nil
+}
+
+// NewFormat compiles the given format string into a Format. The
+// format and options are the same as those given to New.
+//
+// Most users should use New instead. NewFormat is useful to access the
+// typed values of each directive via Format.Values
+func NewFormat(format string, options ...Option) (*Format, error) {
+	return newFormat(format, options)
+}
+
+// newFormat creates a new Format from the given format string,
+// configured using options
+func newFormat(format string, options []Option) (*Format, error) {
+	var remoteIPHeader string
+	var trustedProxies []string
+	var f Format
+	for _, o := range options {
+		switch o.Name() {
+		case optkeyEscape:
+			f.noEscape = !o.Value().(bool)
+		case optkeyLocation:
+			f.location = o.Value().(*time.Location)
+		case optkeyMissingValue:
+			f.missing = []byte(o.Value().(string))
+		case optkeyStrictCompile:
+			f.strict = o.Value().(bool)
+		case optkeyRemoteIPHeader:
+			remoteIPHeader = o.Value().(string)
+		case optkeyServerPort:
+			f.serverPort = o.Value().(int)
+		case optkeyTrustedProxies:
+			trustedProxies = append(trustedProxies, o.Value().([]string)...)
+		}
+	}
+
+	resolver, err := newRemoteIPResolver(remoteIPHeader, trustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure remote IP resolution")
+	}
+	f.remoteIP = resolver
+
+	if err := f.compile(format); err != nil {
+		return nil, errors.Wrap(err, "failed to compile log format")
+	}
+	return &f, nil
+}
+
 func (f *Format) compile(s string) error {
-	var cbs []FormatWriter
+	var directives []directive
+	var needs need
+	var warnings []*CompileError
+
+	appendLiteral := func(v string) {
+		if v == "" {
+			return
+		}
+		if l := len(directives); l > 0 && directives[l-1].isLiteral() {
+			prev := directives[l-1].field.(fixedByteSequence)
+			directives[l-1].field = fixedByteSequence(string(prev) + v)
+			return
+		}
+		directives = append(directives, directive{field: fixedByteSequence(v)})
+	}
+
+	// warn records a problem that can be worked around. In strict mode
+	// it is returned as an error instead
+	warn := func(ce *CompileError) error {
+		if f.strict {
+			return ce
+		}
+		warnings = append(warnings, ce)
+		return nil
+	}
 
 	start := 0
 	max := len(s)
@@ -324,174 +667,257 @@ func (f *Format) compile(s string) error {
 	for i := 0; i < max; {
 		r, n := utf8.DecodeRuneInString(s[i:])
 		if r == utf8.RuneError {
-			return errors.Wrap(ErrInvalidRuneSequence, "failed to compile format")
+			return &CompileError{
+				Offset:     i,
+				Err:        ErrInvalidRuneSequence,
+				Suggestion: "the format must be valid UTF-8",
+			}
 		}
-		i += n
 
-		// Not q sequence... go to next rune
+		// Not a sequence... go to next rune
 		if r != '%' {
+			i += n
 			continue
 		}
 
-		if start != i {
-			// this *could* be the last element in string, in which case we just
-			// say meh, just assume this was a literal percent.
-			if i == max {
-				cbs = append(cbs, fixedByteSequence(s[start:i]))
+		appendLiteral(s[start:i])
+		offset := i
+		i++
+
+		// this *could* be the last element in string, in which case we just
+		// say meh, just assume this was a literal percent.
+		if i == max {
+			if err := warn(&CompileError{
+				Offset:     offset,
+				Directive:  "%",
+				Err:        errors.New("stray '%' at end of format"),
+				Suggestion: "use %% for a literal percent sign",
+			}); err != nil {
+				return err
+			}
+			appendLiteral("%")
+			start = i
+			break
+		}
+
+		// Any directive may be preceded by a status condition, such
+		// as %400,501{User-agent}i or %!200,304{Referer}i
+		var status string
+		var statuses []int
+		var negate bool
+		if l := scanStatusCondition(s[i:]); l > 0 {
+			status = s[i : i+l]
+			i += l
+
+			var err error
+			statuses, negate, err = parseStatusCondition(status)
+			if err == nil && i == max {
+				err = errors.New("status condition is not followed by a directive")
+			}
+			if err != nil {
+				if err := warn(&CompileError{
+					Offset:     offset,
+					Directive:  s[offset:i],
+					Err:        err,
+					Suggestion: "use a comma separated list of status codes followed by a directive, e.g. %400,501{User-agent}i",
+				}); err != nil {
+					return err
+				}
+				appendLiteral(s[offset:i])
 				start = i
-				break
+				continue
 			}
-			cbs = append(cbs, fixedByteSequence(s[start:i-1]))
 		}
 
 		// Find what we have next.
-
 		r, n = utf8.DecodeRuneInString(s[i:])
 		if r == utf8.RuneError {
-			return errors.Wrap(ErrInvalidRuneSequence, "failed to compile format")
+			return &CompileError{
+				Offset:     i,
+				Err:        ErrInvalidRuneSequence,
+				Suggestion: "the format must be valid UTF-8",
+			}
 		}
-		i += n
 
+		var verb, key string
 		switch r {
 		case '%':
-			cbs = append(cbs, fixedByteSequence([]byte{'%'}))
-			start = i + n - 1
-		case 'b':
-			cbs = append(cbs, responseContentLength)
-			start = i + n - 1
-		case 'D': // custom
-			cbs = append(cbs, elapsedTimeMicroSeconds)
-			start = i + n - 1
-		case 'h':
-			cbs = append(cbs, requestRemoteAddr)
-			start = i + n - 1
-		case 'H':
-			cbs = append(cbs, requestHttpProto)
-			start = i + n - 1
-		case 'l':
-			cbs = append(cbs, fixedByteSequence(dashValue))
-			start = i + n - 1
-		case 'm':
-			cbs = append(cbs, requestHttpMethod)
-			start = i + n - 1
-		case 'p':
-			cbs = append(cbs, pid)
-			start = i + n - 1
-		case 'P':
-			// Unimplemented
-			return errors.Wrap(ErrUnimplemented, "failed to compile format")
-		case 'q':
-			cbs = append(cbs, rawQuery)
-			start = i + n - 1
-		case 'r':
-			cbs = append(cbs, requestLine)
-			start = i + n - 1
-		case 's':
-			cbs = append(cbs, httpStatus)
-			start = i + n - 1
-		case 't':
-			cbs = append(cbs, requestTime)
-			start = i + n - 1
-		case 'T': // custom
-			cbs = append(cbs, elapsedTimeSeconds)
-			start = i + n - 1
-		case 'u':
-			cbs = append(cbs, username)
-			start = i + n - 1
-		case 'U':
-			cbs = append(cbs, urlPath)
-			start = i + n - 1
-		case 'V', 'v':
-			cbs = append(cbs, requestHost)
-			start = i + n - 1
-		case '>':
-			if max >= i && s[i] == 's' {
-				// "Last" status doesn't exist in our case, so it's the same as %s
-				cbs = append(cbs, httpStatus)
-				start = i + 1
-				i = i + 1
+			if status != "" {
+				// The condition is dropped in lenient mode
+				if err := warn(&CompileError{
+					Offset:     offset,
+					Directive:  s[offset : i+1],
+					Err:        errors.New("status condition can not be applied to a literal percent sign"),
+					Suggestion: "remove the status condition, or use it with a directive, e.g. %400,501{User-agent}i",
+				}); err != nil {
+					return err
+				}
+			}
+			appendLiteral("%")
+			i++
+			start = i
+			continue
+		case '<', '>':
+			if i+1 < max && s[i+1] == 's' {
+				verb = s[i : i+2]
+				i += 2
 			} else {
 				// Otherwise we don't know what this is. just do a verbatim copy
-				cbs = append(cbs, fixedByteSequence([]byte{'%', '>'}))
-				start = i + n - 1
+				which := "final"
+				if r == '<' {
+					which = "original"
+				}
+				if err := warn(&CompileError{
+					Offset:     offset,
+					Directive:  s[offset : i+1],
+					Err:        errors.Errorf("'%%%c' must be followed by 's'", r),
+					Suggestion: "use %" + string(r) + "s for the " + which + " status, or %% for a literal percent sign",
+				}); err != nil {
+					return err
+				}
+				appendLiteral(s[offset : i+1])
+				i++
+				start = i
+				continue
 			}
 		case '{':
 			// Search the next }
-			end := -1
-			for j := i; j < max; j++ {
-				if s[j] == '}' {
-					end = j
-					break
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 || i+end >= max-1 {
+				ce := CompileError{Offset: offset, Directive: s[offset:]}
+				if end == -1 {
+					ce.Err = errors.New("unterminated '%{' block")
+					ce.Suggestion = "close the block with '}' followed by a directive, e.g. %{Referer}i"
+				} else {
+					ce.Err = errors.New("'%{...}' block is not followed by a directive")
+					ce.Suggestion = "add a directive after '}', e.g. " + s[offset:] + "i"
+				}
+				if err := warn(&ce); err != nil {
+					return err
 				}
+				appendLiteral(s[offset : i+1])
+				i++
+				start = i
+				continue
 			}
-
-			if end != -1 && end < max-1 { // Found it!
-				// check for suffix
-				blockType := s[end+1]
-				key := s[i:end]
-				switch blockType {
-				case 'e': // environment variables
-					cbs = append(cbs, makeEnvVar(key))
-				case 'i':
-					cbs = append(cbs, requestHeader(key))
-				case 'o':
-					cbs = append(cbs, responseHeader(key))
-				case 't':
-					// The time, in the form given by format, which should be in an
-					// extended strftime(3) format (potentially localized). If the
-					// format starts with begin: (default) the time is taken at the
-					// beginning of the request processing. If it starts with end:
-					// it is the time when the log entry gets written, close to the
-					// end of the request processing. In addition to the formats
-					// supported by strftime(3), the following format tokens are
-					// supported:
-					//
-					// sec	number of seconds since the Epoch
-					// msec	number of milliseconds since the Epoch
-					// usec	number of microseconds since the Epoch
-					// msec_frac	millisecond fraction
-					// usec_frac	microsecond fraction
-					//
-					// These tokens can not be combined with each other or strftime(3)
-					// formatting in the same format string. You can use multiple
-					// %{format}t tokens instead.
-					formatter, err := timeFormatter(key)
-					if err != nil {
-						return err
-					}
-					cbs = append(cbs, formatter)
-				case 'T':
-					formatter, err := elapsedFormatter(key)
-					if err != nil {
-						return err
-					}
-					cbs = append(cbs, formatter)
-				default:
-					return errors.Wrap(ErrUnimplemented, "failed to compile format")
+			end += i
+			key = s[i+1 : end]
+			r, n = utf8.DecodeRuneInString(s[end+1:])
+			if r == utf8.RuneError {
+				return &CompileError{
+					Offset:     end + 1,
+					Err:        ErrInvalidRuneSequence,
+					Suggestion: "the format must be valid UTF-8",
 				}
+			}
+			if r == '^' {
+				// two letter directives, such as ^ti and ^to
+				n = 3
+				if end+1+n > max {
+					n = max - end - 1
+				}
+			}
+			verb = s[end+1 : end+1+n]
+			i = end + 1 + n
+		default:
+			verb = string(r)
+			i += n
+		}
+		start = i
+
+		if key != "" && keylessVerbs[verb] {
+			// The key is dropped in lenient mode
+			if err := warn(&CompileError{
+				Offset:     offset,
+				Directive:  s[offset:i],
+				Err:        errUnexpectedKey,
+				Suggestion: f.suggestFix(verb, key, errUnexpectedKey),
+			}); err != nil {
+				return err
+			}
+			key = ""
+		}
 
-				start = end + 2
-				i = end + 1
-			} else {
-				cbs = append(cbs, fixedByteSequence([]byte{'%', '{'}))
-				start = i + n - 1
+		fld, err := f.makeField(verb, key)
+		if err != nil {
+			return &CompileError{
+				Offset:     offset,
+				Directive:  s[offset:i],
+				Err:        err,
+				Suggestion: f.suggestFix(verb, key, err),
 			}
 		}
+		if fld == nil {
+			// Unknown single character directives are dropped
+			if err := warn(&CompileError{
+				Offset:     offset,
+				Directive:  s[offset:i],
+				Err:        errors.Wrap(ErrUnimplemented, "unknown directive"),
+				Suggestion: f.suggestFix(verb, key, ErrUnimplemented),
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		if statuses != nil {
+			fld = &conditionalField{field: fld, negate: negate, statuses: statuses}
+		}
+		directives = append(directives, directive{verb: verb, key: key, status: status, field: fld})
+		needs |= directiveNeeds(verb, key)
 	}
 
 	if start < max {
-		cbs = append(cbs, fixedByteSequence(s[start:max]))
+		appendLiteral(s[start:max])
 	}
 
-	f.writers = cbs
+	f.directives = directives
+	f.needs = needs
+	f.warnings = warnings
 	return nil
 }
 
+// Warnings returns the problems that were found, and worked around,
+// while compiling the format in lenient mode. It is always empty in
+// strict mode, as such problems are reported as errors instead
+func (f *Format) Warnings() []*CompileError {
+	return f.warnings
+}
+
+// WriteTo writes the log line for ctx to dst. Unless escaping has
+// been disabled, string values are escaped using the same rules as
+// Apache, so that untrusted values such as request headers can not
+// break or forge log lines.
 func (f *Format) WriteTo(dst io.Writer, ctx LogCtx) error {
-	for _, w := range f.writers {
-		if err := w.WriteTo(dst, ctx); err != nil {
-			return errors.Wrap(err, "failed to execute FormatWriter")
+	buf := getLogBuffer()
+	defer releaseLogBuffer(buf)
+
+	b := buf.Bytes()
+	for _, d := range f.directives {
+		if d.isLiteral() {
+			b = append(b, d.field.(fixedByteSequence)...)
+			continue
 		}
+		b = f.appendValue(b, d.field, d.field.Extract(ctx))
+	}
+
+	if _, err := dst.Write(b); err != nil {
+		return errors.Wrap(err, "failed to write log line")
 	}
 	return nil
 }
+
+// Values extracts the typed values of each directive in the format
+// from ctx. Literal text is not included.
+func (f *Format) Values(ctx LogCtx) []FieldValue {
+	values := make([]FieldValue, 0, len(f.directives))
+	for _, d := range f.directives {
+		if d.isLiteral() {
+			continue
+		}
+		values = append(values, FieldValue{
+			Directive: d.String(),
+			Value:     d.field.Extract(ctx),
+		})
+	}
+	return values
+}
@@ -1,6 +1,6 @@
 module github.com/lestrrat-go/apache-logformat/v2
 
-go 1.12
+go 1.14
 
 require (
 	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a
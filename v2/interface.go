@@ -8,7 +8,20 @@ import (
 )
 
 type ApacheLog struct {
-	format *Format
+	childSpan               bool
+	clock                   Clock
+	errorHandler            func(error, *http.Request)
+	format                  FormatWriter
+	needs                   need
+	requestIDGenerator      RequestIDGenerator
+	requestIDHeader         string
+	requestIDResponseHeader string
+	warnings                []*CompileError
+}
+
+// Clock is the interface used to obtain the current time
+type Clock interface {
+	Now() time.Time
 }
 
 // Combined is a pre-defined ApacheLog struct to log "common" log format
@@ -25,7 +38,15 @@ var (
 // Format describes an Apache log format. Given a logging context,
 // it can create a log line.
 type Format struct {
-	writers []FormatWriter
+	directives []directive
+	location   *time.Location
+	missing    []byte
+	needs      need
+	noEscape   bool
+	remoteIP   *remoteIPResolver
+	serverPort int
+	strict     bool
+	warnings   []*CompileError
 }
 
 type LogCtx interface {
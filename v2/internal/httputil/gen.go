@@ -0,0 +1,102 @@
+//go:build ignore
+// +build ignore
+
+// gen.go generates the ResponseWriter variants that expose each
+// combination of optional interfaces. Run it with `go generate`
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+type iface struct {
+	name      string // name used in the generated type names
+	adapter   string // adapter type that implements the interface
+	check     string // interface that the underlying writer must implement
+	signature string // signature of the method of the interface
+	call      string // call of the method of the adapter
+	returns   bool   // the method has results
+}
+
+var ifaces = []iface{
+	{"Flush", "flusher", "http.Flusher", "Flush()", "Flush()", false},
+	{"Hijack", "hijacker", "http.Hijacker", "Hijack() (net.Conn, *bufio.ReadWriter, error)", "Hijack()", true},
+	{"Push", "pusher", "http.Pusher", "Push(target string, opts *http.PushOptions) error", "Push(target, opts)", true},
+	{"ReadFrom", "readerFrom", "io.ReaderFrom", "ReadFrom(src io.Reader) (int64, error)", "ReadFrom(src)", true},
+	{"CloseNotify", "closeNotifier", "http.CloseNotifier", "CloseNotify() <-chan bool", "CloseNotify()", true},
+}
+
+func typeName(mask int) string {
+	var b strings.Builder
+	for i, iface := range ifaces {
+		if mask&(1<<uint(i)) != 0 {
+			b.WriteString(iface.name)
+		}
+	}
+	name := b.String()
+	if name == "" {
+		return "plainResponseWriter"
+	}
+	return strings.ToLower(name[:1]) + name[1:] + "ResponseWriter"
+}
+
+func main() {
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gen.go. DO NOT EDIT.\n\n")
+	buf.WriteString("package httputil\n\n")
+	buf.WriteString("import (\n\"bufio\"\n\"io\"\n\"net\"\n\"net/http\"\n)\n\n")
+
+	// Each type only holds a single pointer, so that it can be stored
+	// in an interface without allocating
+	combinations := 1 << uint(len(ifaces))
+	for mask := 0; mask < combinations; mask++ {
+		fmt.Fprintf(&buf, "type %s struct {\n", typeName(mask))
+		buf.WriteString("*baseWriter\n")
+		buf.WriteString("}\n\n")
+		for i, iface := range ifaces {
+			if mask&(1<<uint(i)) == 0 {
+				continue
+			}
+			fmt.Fprintf(&buf, "func (w %s) %s {\n", typeName(mask), iface.signature)
+			if iface.returns {
+				buf.WriteString("return ")
+			}
+			fmt.Fprintf(&buf, "(*%s)(w.baseWriter).%s\n", iface.adapter, iface.call)
+			buf.WriteString("}\n\n")
+		}
+	}
+
+	buf.WriteString("// interfaceMask returns the set of optional interfaces implemented by w\n")
+	buf.WriteString("func interfaceMask(w http.ResponseWriter) int {\n")
+	buf.WriteString("var mask int\n")
+	for i, iface := range ifaces {
+		fmt.Fprintf(&buf, "if _, ok := w.(%s); ok {\nmask |= %d\n}\n", iface.check, 1<<uint(i))
+	}
+	buf.WriteString("return mask\n")
+	buf.WriteString("}\n\n")
+
+	buf.WriteString("// expose returns an http.ResponseWriter backed by rw, that implements\n")
+	buf.WriteString("// the optional interfaces specified by mask\n")
+	buf.WriteString("func expose(rw *ResponseWriter, mask int) http.ResponseWriter {\n")
+	buf.WriteString("switch mask {\n")
+	for mask := 0; mask < combinations; mask++ {
+		fmt.Fprintf(&buf, "case %d:\n", mask)
+		fmt.Fprintf(&buf, "return %s{baseWriter: (*baseWriter)(rw)}\n", typeName(mask))
+	}
+	buf.WriteString("}\n")
+	buf.WriteString("return (*baseWriter)(rw)\n")
+	buf.WriteString("}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("failed to format generated source: %s", err)
+	}
+	if err := ioutil.WriteFile("responsewriter_gen.go", src, 0644); err != nil {
+		log.Fatalf("failed to write generated source: %s", err)
+	}
+}
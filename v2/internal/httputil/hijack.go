@@ -0,0 +1,97 @@
+package httputil
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// HijackedConn is a net.Conn returned from http.Hijacker.Hijack, that
+// counts the bytes that are read and written through it, and notifies
+// a callback when it is closed
+type HijackedConn struct {
+	// read and written are accessed atomically, and must be kept at the
+	// top of the struct to be 64-bit aligned
+	read    int64
+	written int64
+
+	net.Conn
+
+	mu      sync.Mutex
+	closed  bool
+	onClose func()
+}
+
+// newHijackedConn wraps conn, and creates a new bufio.ReadWriter that
+// reads and writes through the wrapped connection. Data that was
+// already buffered in brw is preserved, and is counted as read
+func newHijackedConn(conn net.Conn, brw *bufio.ReadWriter) (*HijackedConn, *bufio.ReadWriter) {
+	hc := &HijackedConn{Conn: conn}
+
+	var r io.Reader = hc
+	if brw != nil && brw.Reader.Buffered() > 0 {
+		buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+		hc.read = int64(len(buffered))
+		r = io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), hc)
+	}
+	return hc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(hc))
+}
+
+func (c *HijackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *HijackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Close closes the connection. The callback registered via OnClose
+// is called the first time Close is called
+func (c *HijackedConn) Close() error {
+	err := c.Conn.Close()
+
+	c.mu.Lock()
+	var fn func()
+	if !c.closed {
+		c.closed = true
+		fn = c.onClose
+	}
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+	return err
+}
+
+// OnClose registers fn to be called when the connection is closed.
+// If the connection has already been closed, fn is called immediately
+func (c *HijackedConn) OnClose(fn func()) {
+	c.mu.Lock()
+	closed := c.closed
+	if !closed {
+		c.onClose = fn
+	}
+	c.mu.Unlock()
+
+	if closed {
+		fn()
+	}
+}
+
+// BytesRead returns the number of bytes read from the connection
+func (c *HijackedConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten returns the number of bytes written to the connection
+func (c *HijackedConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
@@ -1,7 +1,13 @@
 package httputil
 
+//go:generate go run gen.go
+
 import (
+	"bufio"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 )
 
@@ -12,9 +18,15 @@ func init() {
 }
 
 type ResponseWriter struct {
+	hijacked              *HijackedConn
+	informational         []int
+	originalStatus        int
 	responseContentLength int64
 	responseStatus        int
 	responseWriter        http.ResponseWriter
+	sentHeader            http.Header
+	snapshot              bool
+	superfluous           []int
 }
 
 func GetResponseWriter(w http.ResponseWriter) *ResponseWriter {
@@ -38,17 +50,149 @@ func (rw ResponseWriter) ContentLength() int64 {
 	return rw.responseContentLength
 }
 
+// StatusCode returns the status that was sent, which is the first
+// status written either via WriteHeader or implicitly via Write
 func (rw ResponseWriter) StatusCode() int {
 	return rw.responseStatus
 }
 
+// OriginalStatusCode returns the first status written, either via
+// WriteHeader or implicitly via Write
+func (rw ResponseWriter) OriginalStatusCode() int {
+	if rw.originalStatus == 0 {
+		return rw.responseStatus
+	}
+	return rw.originalStatus
+}
+
+// SuperfluousStatusCodes returns the statuses passed to WriteHeader
+// after the status was sent, which net/http ignores
+func (rw ResponseWriter) SuperfluousStatusCodes() []int {
+	return rw.superfluous
+}
+
+// InformationalStatusCodes returns the 1xx statuses written before the
+// final status, such as 103 Early Hints
+func (rw ResponseWriter) InformationalStatusCodes() []int {
+	return rw.informational
+}
+
+// SnapshotHeader makes rw take a copy of the response headers when
+// they are sent, which SentHeader then returns
+func (rw *ResponseWriter) SnapshotHeader() {
+	rw.snapshot = true
+}
+
+// SentHeader returns a copy of the response headers, as they were when
+// the headers were sent. If they have not been sent yet, the current
+// headers are returned. Trailers are not included. Unless SnapshotHeader
+// was called, the current headers are returned as is instead
+func (rw *ResponseWriter) SentHeader() http.Header {
+	if !rw.snapshot {
+		return rw.responseWriter.Header()
+	}
+	if rw.sentHeader == nil {
+		return snapshotHeader(rw.responseWriter.Header())
+	}
+	return rw.sentHeader
+}
+
+// Trailer returns the response trailers, which are either declared in
+// the "Trailer" header before the headers are sent, or set using keys
+// prefixed with http.TrailerPrefix. It returns nil if there are none
+func (rw *ResponseWriter) Trailer() http.Header {
+	h := rw.responseWriter.Header()
+
+	var trailer http.Header
+	add := func(key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if trailer == nil {
+			trailer = http.Header{}
+		}
+		trailer[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+
+	declared := h
+	if rw.sentHeader != nil {
+		declared = rw.sentHeader
+	}
+	for _, v := range declared["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				add(key, h[http.CanonicalHeaderKey(key)])
+			}
+		}
+	}
+	for key, values := range h {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			add(strings.TrimPrefix(key, http.TrailerPrefix), values)
+		}
+	}
+	return trailer
+}
+
+// markHeaderSent takes a snapshot of the headers, if SnapshotHeader was
+// called, the first time that it is called. It must be called before anything that makes the
+// wrapped http.ResponseWriter send the headers
+func (rw *ResponseWriter) markHeaderSent() {
+	if rw.snapshot && rw.sentHeader == nil {
+		rw.sentHeader = snapshotHeader(rw.responseWriter.Header())
+	}
+}
+
+// snapshotHeader copies the headers in h that are sent before the
+// body, excluding trailers
+func snapshotHeader(h http.Header) http.Header {
+	var excluded map[string]struct{}
+	for _, v := range h["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				if excluded == nil {
+					excluded = make(map[string]struct{})
+				}
+				excluded[http.CanonicalHeaderKey(key)] = struct{}{}
+			}
+		}
+	}
+
+	snapshot := make(http.Header, len(h))
+	for key, values := range h {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		if _, ok := excluded[key]; ok {
+			continue
+		}
+		snapshot[key] = append([]string(nil), values...)
+	}
+	return snapshot
+}
+
+// Hijacked returns the connection that was hijacked from rw, or nil
+// if the connection has not been hijacked
+func (rw ResponseWriter) Hijacked() *HijackedConn {
+	return rw.hijacked
+}
+
 func (rw *ResponseWriter) Reset() {
+	rw.hijacked = nil
+	rw.informational = rw.informational[:0]
+	rw.originalStatus = 0
 	rw.responseContentLength = 0
 	rw.responseStatus = http.StatusOK
 	rw.responseWriter = nil
+	rw.sentHeader = nil
+	rw.snapshot = false
+	rw.superfluous = rw.superfluous[:0]
 }
 
 func (rw *ResponseWriter) Write(buf []byte) (int, error) {
+	if rw.originalStatus == 0 {
+		rw.originalStatus = http.StatusOK
+	}
+	rw.markHeaderSent()
 	n, err := rw.responseWriter.Write(buf)
 	rw.responseContentLength += int64(n)
 	return n, err
@@ -59,12 +203,112 @@ func (rw *ResponseWriter) Header() http.Header {
 }
 
 func (rw *ResponseWriter) WriteHeader(status int) {
+	// 1xx statuses other than 101 Switching Protocols are informational,
+	// and are followed by the final status
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		rw.informational = append(rw.informational, status)
+		rw.responseWriter.WriteHeader(status)
+		return
+	}
+
+	// net/http only sends the first status, and ignores later ones
+	if rw.originalStatus != 0 {
+		rw.superfluous = append(rw.superfluous, status)
+		rw.responseWriter.WriteHeader(status)
+		return
+	}
+
+	rw.originalStatus = status
 	rw.responseStatus = status
+	rw.markHeaderSent()
 	rw.responseWriter.WriteHeader(status)
 }
 
+// Flush flushes the http.ResponseWriter that rw wraps, if it
+// implements http.Flusher
 func (rw *ResponseWriter) Flush() {
 	if f, ok := rw.responseWriter.(http.Flusher); ok {
+		rw.markHeaderSent()
 		f.Flush()
 	}
 }
+
+// Unwrap returns the http.ResponseWriter that rw wraps, so that
+// http.ResponseController can reach it
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.responseWriter
+}
+
+// Expose returns an http.ResponseWriter backed by rw, that implements
+// exactly the optional interfaces (http.Flusher, http.Hijacker,
+// http.Pusher, io.ReaderFrom and http.CloseNotifier) that are
+// implemented by the http.ResponseWriter that rw wraps
+func Expose(rw *ResponseWriter) http.ResponseWriter {
+	return expose(rw, interfaceMask(rw.responseWriter))
+}
+
+// The following types are used by the types generated by gen.go.
+// baseWriter, which they embed, implements http.ResponseWriter, and
+// each of the others implements a single optional interface, by
+// delegating to the ResponseWriter that they are converted from
+
+type baseWriter ResponseWriter
+
+func (b *baseWriter) Header() http.Header {
+	return (*ResponseWriter)(b).Header()
+}
+
+func (b *baseWriter) Write(buf []byte) (int, error) {
+	return (*ResponseWriter)(b).Write(buf)
+}
+
+func (b *baseWriter) WriteHeader(status int) {
+	(*ResponseWriter)(b).WriteHeader(status)
+}
+
+func (b *baseWriter) Unwrap() http.ResponseWriter {
+	return b.responseWriter
+}
+
+type flusher ResponseWriter
+
+func (f *flusher) Flush() {
+	(*ResponseWriter)(f).markHeaderSent()
+	f.responseWriter.(http.Flusher).Flush()
+}
+
+type hijacker ResponseWriter
+
+func (h *hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := h.responseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	hc, brw := newHijackedConn(conn, brw)
+	h.hijacked = hc
+	return hc, brw, nil
+}
+
+type pusher ResponseWriter
+
+func (p *pusher) Push(target string, opts *http.PushOptions) error {
+	return p.responseWriter.(http.Pusher).Push(target, opts)
+}
+
+type readerFrom ResponseWriter
+
+func (rf *readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	if rf.originalStatus == 0 {
+		rf.originalStatus = http.StatusOK
+	}
+	(*ResponseWriter)(rf).markHeaderSent()
+	n, err := rf.responseWriter.(io.ReaderFrom).ReadFrom(src)
+	rf.responseContentLength += n
+	return n, err
+}
+
+type closeNotifier ResponseWriter
+
+func (cn *closeNotifier) CloseNotify() <-chan bool {
+	return cn.responseWriter.(http.CloseNotifier).CloseNotify()
+}
@@ -0,0 +1,551 @@
+// Code generated by gen.go. DO NOT EDIT.
+
+package httputil
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+type plainResponseWriter struct {
+	*baseWriter
+}
+
+type flushResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+type hijackResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+type flushHijackResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+type pushResponseWriter struct {
+	*baseWriter
+}
+
+func (w pushResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+type flushPushResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushPushResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushPushResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+type hijackPushResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackPushResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackPushResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+type flushHijackPushResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackPushResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackPushResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackPushResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+type readFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w readFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type flushReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushReadFromResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type hijackReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackReadFromResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type flushHijackReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackReadFromResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackReadFromResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type pushReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w pushReadFromResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w pushReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type flushPushReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushPushReadFromResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushPushReadFromResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushPushReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type hijackPushReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackPushReadFromResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackPushReadFromResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w hijackPushReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type flushHijackPushReadFromResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackPushReadFromResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackPushReadFromResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackPushReadFromResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushHijackPushReadFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+type closeNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w closeNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type hijackCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushHijackCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type pushCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w pushCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w pushCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushPushCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushPushCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushPushCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushPushCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type hijackPushCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackPushCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackPushCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w hijackPushCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushHijackPushCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackPushCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackPushCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackPushCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushHijackPushCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type readFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w readFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w readFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushReadFromCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w flushReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type hijackReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackReadFromCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w hijackReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushHijackReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackReadFromCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackReadFromCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w flushHijackReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type pushReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w pushReadFromCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w pushReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w pushReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushPushReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushPushReadFromCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushPushReadFromCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushPushReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w flushPushReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type hijackPushReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w hijackPushReadFromCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w hijackPushReadFromCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w hijackPushReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w hijackPushReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+type flushHijackPushReadFromCloseNotifyResponseWriter struct {
+	*baseWriter
+}
+
+func (w flushHijackPushReadFromCloseNotifyResponseWriter) Flush() {
+	(*flusher)(w.baseWriter).Flush()
+}
+
+func (w flushHijackPushReadFromCloseNotifyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return (*hijacker)(w.baseWriter).Hijack()
+}
+
+func (w flushHijackPushReadFromCloseNotifyResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return (*pusher)(w.baseWriter).Push(target, opts)
+}
+
+func (w flushHijackPushReadFromCloseNotifyResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return (*readerFrom)(w.baseWriter).ReadFrom(src)
+}
+
+func (w flushHijackPushReadFromCloseNotifyResponseWriter) CloseNotify() <-chan bool {
+	return (*closeNotifier)(w.baseWriter).CloseNotify()
+}
+
+// interfaceMask returns the set of optional interfaces implemented by w
+func interfaceMask(w http.ResponseWriter) int {
+	var mask int
+	if _, ok := w.(http.Flusher); ok {
+		mask |= 1
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		mask |= 2
+	}
+	if _, ok := w.(http.Pusher); ok {
+		mask |= 4
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		mask |= 8
+	}
+	if _, ok := w.(http.CloseNotifier); ok {
+		mask |= 16
+	}
+	return mask
+}
+
+// expose returns an http.ResponseWriter backed by rw, that implements
+// the optional interfaces specified by mask
+func expose(rw *ResponseWriter, mask int) http.ResponseWriter {
+	switch mask {
+	case 0:
+		return plainResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 1:
+		return flushResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 2:
+		return hijackResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 3:
+		return flushHijackResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 4:
+		return pushResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 5:
+		return flushPushResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 6:
+		return hijackPushResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 7:
+		return flushHijackPushResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 8:
+		return readFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 9:
+		return flushReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 10:
+		return hijackReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 11:
+		return flushHijackReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 12:
+		return pushReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 13:
+		return flushPushReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 14:
+		return hijackPushReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 15:
+		return flushHijackPushReadFromResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 16:
+		return closeNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 17:
+		return flushCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 18:
+		return hijackCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 19:
+		return flushHijackCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 20:
+		return pushCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 21:
+		return flushPushCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 22:
+		return hijackPushCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 23:
+		return flushHijackPushCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 24:
+		return readFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 25:
+		return flushReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 26:
+		return hijackReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 27:
+		return flushHijackReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 28:
+		return pushReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 29:
+		return flushPushReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 30:
+		return hijackPushReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	case 31:
+		return flushHijackPushReadFromCloseNotifyResponseWriter{baseWriter: (*baseWriter)(rw)}
+	}
+	return (*baseWriter)(rw)
+}
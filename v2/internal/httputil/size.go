@@ -0,0 +1,137 @@
+package httputil
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const crlfLen = 2
+
+// headerSize returns the number of bytes used by h on the wire,
+// including the CRLF at the end of each line
+func headerSize(h http.Header) int64 {
+	var n int64
+	for name, values := range h {
+		for _, v := range values {
+			n += int64(len(name) + len(": ") + len(v) + crlfLen)
+		}
+	}
+	return n
+}
+
+// RequestHeaderSize estimates the size of the request line and headers
+// of r, as received by the server. The Host header, which net/http
+// removes from r.Header, is included
+func RequestHeaderSize(r *http.Request) int64 {
+	n := int64(len(r.Method) + len(" ") + len(r.RequestURI) + len(" ") + len(r.Proto) + crlfLen)
+	if r.RequestURI == "" && r.URL != nil {
+		n += int64(len(r.URL.RequestURI()))
+	}
+	if r.Host != "" {
+		n += int64(len("Host: ") + len(r.Host) + crlfLen)
+	}
+	return n + headerSize(r.Header) + crlfLen
+}
+
+// dateHeaderSize is the size of the Date header that net/http adds to
+// responses, e.g. "Date: Tue, 29 Sep 2020 12:34:56 GMT\r\n"
+const dateHeaderSize = int64(len("Date: ") + len(http.TimeFormat) + crlfLen)
+
+// ResponseHeaderSize estimates the size of the status line and headers
+// of a response to r with the given status, headers and body length,
+// when nothing else is known about how the response was written. The
+// Date and Content-Length headers added by net/http are accounted for
+// when they are missing from h. The framing of chunked bodies, and
+// the headers that net/http may add by itself, such as a sniffed
+// Content-Type, are not
+func ResponseHeaderSize(r *http.Request, status int, h http.Header, contentLength int64) int64 {
+	proto := "HTTP/1.1"
+	if r != nil && r.Proto != "" {
+		proto = r.Proto
+	}
+	n := int64(len(proto) + len(" ") + 3 + len(" ") + len(http.StatusText(status)) + crlfLen)
+	n += headerSize(h)
+	if h.Get("Date") == "" {
+		n += dateHeaderSize
+	}
+	if h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" {
+		n += int64(len("Content-Length: ") + len(strconv.FormatInt(contentLength, 10)) + crlfLen)
+	}
+	return n + crlfLen
+}
+
+// CountingConn is a net.Conn that counts the bytes read from and
+// written to the connection that it wraps
+type CountingConn struct {
+	// read and written are accessed atomically, and must be kept at the
+	// top of the struct to be 64-bit aligned
+	read    int64
+	written int64
+
+	net.Conn
+}
+
+// NewCountingConn wraps conn
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection
+func (c *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+// BytesWritten returns the number of bytes written to the connection
+func (c *CountingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// CountingBody is an io.ReadCloser that counts the bytes read from
+// the request body that it wraps
+type CountingBody struct {
+	// n is accessed atomically, and must be kept at the top of the
+	// struct to be 64-bit aligned
+	n int64
+	io.ReadCloser
+}
+
+// CountBody replaces the body of r with a CountingBody. It returns nil
+// if r has no body
+func CountBody(r *http.Request) *CountingBody {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	b := &CountingBody{ReadCloser: r.Body}
+	r.Body = b
+	return b
+}
+
+func (b *CountingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the body. It is
+// safe to call on a nil *CountingBody
+func (b *CountingBody) BytesRead() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.n)
+}
@@ -21,13 +21,23 @@ func (_ defaultClock) Now() time.Time {
 var Clock clock = defaultClock{}
 
 type Context struct {
+	aborted               bool
+	body                  *httputil.CountingBody
+	bytesReceived         int64
+	bytesSent             int64
+	clock                 clock
 	elapsedTime           time.Duration
+	hijacked              bool
+	informationalStatuses []int
+	originalStatus        int
 	request               *http.Request
 	requestTime           time.Time
 	responseContentLength int64
 	responseHeader        http.Header
 	responseStatus        int
 	responseTime          time.Time
+	responseTrailer       http.Header
+	superfluousStatuses   []int
 }
 
 var pool = sync.Pool{New: allocCtx}
@@ -36,22 +46,85 @@ func allocCtx() interface{} {
 	return &Context{}
 }
 
+// Get returns a Context for r, using the package-wide Clock
 func Get(r *http.Request) *Context {
+	return GetWithClock(r, nil)
+}
+
+// GetWithClock returns a Context for r, using c to obtain the current
+// time. If c is nil, the package-wide Clock is used
+func GetWithClock(r *http.Request, c clock) *Context {
+	if c == nil {
+		c = Clock
+	}
 	ctx := pool.Get().(*Context)
+	ctx.clock = c
 	ctx.request = r
-	ctx.requestTime = Clock.Now()
+	ctx.requestTime = c.Now()
 	return ctx
 }
 
+// CountBody counts the bytes read from the body of the request, so
+// that they are included in BytesReceived
+func (ctx *Context) CountBody() {
+	ctx.body = httputil.CountBody(ctx.request)
+}
+
 func Release(ctx *Context) {
 	ctx.Reset()
 	pool.Put(ctx)
 }
 
+// Aborted returns true if the client went away before the response
+// was completed
+func (ctx *Context) Aborted() bool {
+	return ctx.aborted
+}
+
+// SetAborted records that the client went away before the response
+// was completed
+func (ctx *Context) SetAborted() {
+	ctx.aborted = true
+}
+
+// BytesReceived returns the number of bytes received for the request,
+// including the request line and headers
+func (ctx *Context) BytesReceived() int64 {
+	return ctx.bytesReceived
+}
+
+// BytesSent returns the number of bytes sent for the response,
+// including the status line and headers
+func (ctx *Context) BytesSent() int64 {
+	return ctx.bytesSent
+}
+
 func (ctx *Context) ElapsedTime() time.Duration {
 	return ctx.elapsedTime
 }
 
+// Hijacked returns true if the connection was hijacked
+func (ctx *Context) Hijacked() bool {
+	return ctx.hijacked
+}
+
+// InformationalResponseStatuses returns the 1xx statuses that were
+// written before the final status
+func (ctx *Context) InformationalResponseStatuses() []int {
+	return ctx.informationalStatuses
+}
+
+// OriginalResponseStatus returns the first status written
+func (ctx *Context) OriginalResponseStatus() int {
+	return ctx.originalStatus
+}
+
+// SuperfluousResponseStatuses returns the statuses written after the
+// status was sent, which were ignored
+func (ctx *Context) SuperfluousResponseStatuses() []int {
+	return ctx.superfluousStatuses
+}
+
 func (ctx *Context) Request() *http.Request {
 	return ctx.request
 }
@@ -72,24 +145,79 @@ func (ctx *Context) ResponseStatus() int {
 	return ctx.responseStatus
 }
 
+// ResponseTrailer returns the trailers sent after the response body
+func (ctx *Context) ResponseTrailer() http.Header {
+	return ctx.responseTrailer
+}
+
 func (ctx *Context) ResponseTime() time.Time {
 	return ctx.responseTime
 }
 
 func (ctx *Context) Reset() {
+	ctx.aborted = false
+	ctx.body = nil
+	ctx.bytesReceived = 0
+	ctx.bytesSent = 0
+	ctx.clock = nil
 	ctx.elapsedTime = time.Duration(0)
+	ctx.hijacked = false
+	ctx.informationalStatuses = nil
+	ctx.originalStatus = 0
 	ctx.request = nil
 	ctx.requestTime = time.Time{}
 	ctx.responseContentLength = 0
-	ctx.responseHeader = http.Header{}
+	ctx.responseHeader = nil
 	ctx.responseStatus = http.StatusOK
 	ctx.responseTime = time.Time{}
+	ctx.responseTrailer = nil
+	ctx.superfluousStatuses = nil
 }
 
 func (ctx *Context) Finalize(wrapped *httputil.ResponseWriter) {
-	ctx.responseTime = Clock.Now()
-	ctx.elapsedTime = ctx.responseTime.Sub(ctx.requestTime)
+	ctx.finalizeTime()
 	ctx.responseContentLength = wrapped.ContentLength()
-	ctx.responseHeader = wrapped.Header()
+	ctx.responseHeader = wrapped.SentHeader()
+	ctx.responseTrailer = wrapped.Trailer()
 	ctx.responseStatus = wrapped.StatusCode()
+	ctx.originalStatus = wrapped.OriginalStatusCode()
+	if codes := wrapped.InformationalStatusCodes(); len(codes) > 0 {
+		ctx.informationalStatuses = append([]int(nil), codes...)
+	}
+	if codes := wrapped.SuperfluousStatusCodes(); len(codes) > 0 {
+		ctx.superfluousStatuses = append([]int(nil), codes...)
+	}
+	ctx.bytesReceived = httputil.RequestHeaderSize(ctx.request) + ctx.body.BytesRead()
+	ctx.bytesSent = httputil.ResponseHeaderSize(ctx.request, ctx.responseStatus, ctx.responseHeader, ctx.responseContentLength) + ctx.responseContentLength
+}
+
+// SetTransferred overrides the number of bytes received and sent, with
+// the numbers counted on the connection
+func (ctx *Context) SetTransferred(received, sent int64) {
+	ctx.bytesReceived = received
+	ctx.bytesSent = sent
+}
+
+// FinalizeHijacked is used instead of Finalize when the connection was
+// hijacked. It should be called once conn has been closed, so that the
+// elapsed time covers the whole session. header is the response header
+// at the time the connection was hijacked
+func (ctx *Context) FinalizeHijacked(header http.Header, conn *httputil.HijackedConn) {
+	ctx.finalizeTime()
+	ctx.responseContentLength = conn.BytesWritten()
+	ctx.responseHeader = header
+	ctx.hijacked = true
+	ctx.responseStatus = http.StatusSwitchingProtocols
+	ctx.originalStatus = http.StatusSwitchingProtocols
+	ctx.bytesReceived = httputil.RequestHeaderSize(ctx.request) + ctx.body.BytesRead() + conn.BytesRead()
+	ctx.bytesSent = conn.BytesWritten()
+}
+
+func (ctx *Context) finalizeTime() {
+	c := ctx.clock
+	if c == nil {
+		c = Clock
+	}
+	ctx.responseTime = c.Now()
+	ctx.elapsedTime = ctx.responseTime.Sub(ctx.requestTime)
 }
@@ -0,0 +1,127 @@
+package apachelog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jsonEncoder writes log lines as JSON objects, one key per field
+type jsonEncoder struct {
+	fields []labeledFormat
+}
+
+// NewJSON creates a new ApacheLog instance that writes each log line
+// as a JSON object. The keys of fields are used as the JSON keys, and
+// the values are formats that use the same syntax as New.
+//
+// When a format consists of a single directive, its value is written
+// using the most natural JSON type: for example %>s and %b produce
+// numbers, %t produces an RFC 3339 timestamp, and directives that
+// would have been logged as "-" produce null. Times with an explicit
+// format, such as %{%Y-%m-%d}t, are written as strings in that format.
+// Any other format is written as a string.
+//
+//	al, err := apachelog.NewJSON(map[string]string{
+//	  "remote_addr":  "%h",
+//	  "request_time": "%t",
+//	  "status":       "%>s",
+//	  "bytes":        "%b",
+//	  "user_agent":   "%{User-Agent}i",
+//	})
+//
+// Keys are written in lexical order.
+func NewJSON(fields map[string]string, options ...Option) (*ApacheLog, error) {
+	compiled, err := compileLabeled("JSON", fields, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newApacheLog(&jsonEncoder{fields: compiled}, labeledWarnings(compiled), labeledNeeds(compiled), options), nil
+}
+
+func (enc *jsonEncoder) WriteTo(dst io.Writer, ctx LogCtx) error {
+	buf := getLogBuffer()
+	defer releaseLogBuffer(buf)
+
+	out := getLogBuffer()
+	defer releaseLogBuffer(out)
+
+	out.WriteByte('{')
+	for i, field := range enc.fields {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+
+		name, err := json.Marshal(field.label)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode JSON key")
+		}
+		out.Write(name)
+		out.WriteByte(':')
+
+		buf.Reset()
+		v, err := jsonValue(buf, field.format, ctx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to compute value for JSON field %s", strconv.Quote(field.label))
+		}
+
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode value for JSON field %s", strconv.Quote(field.label))
+		}
+		out.Write(encoded)
+	}
+	out.WriteByte('}')
+
+	if _, err := out.WriteTo(dst); err != nil {
+		return errors.Wrap(err, "failed to write JSON object")
+	}
+	return nil
+}
+
+// jsonValue computes the value of f as a JSON compatible value.
+// buf is used as scratch space.
+func jsonValue(buf *bytes.Buffer, f *Format, ctx LogCtx) (interface{}, error) {
+	if len(f.directives) != 1 || f.directives[0].isLiteral() {
+		if err := f.WriteTo(buf, ctx); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	}
+
+	d := f.directives[0]
+	fld := d.field
+	v := fld.Extract(ctx)
+	switch v.Kind() {
+	case KindMissing:
+		return nil, nil
+	case KindString:
+		return v.str, nil
+	case KindInt:
+		return v.Int(), nil
+	case KindTime:
+		if d.verb != "t" || d.key != "" {
+			return string(f.appendValue(buf.Bytes(), fld, v)), nil
+		}
+		t := v.Time()
+		if f.location != nil {
+			t = t.In(f.location)
+		}
+		return t.Format(time.RFC3339), nil
+	case KindDuration:
+		// Durations are written in the unit of the directive, e.g.
+		// microseconds for %D
+		if ta, ok := fld.(textAppender); ok {
+			text := ta.appendText(buf.Bytes(), v)
+			if _, err := strconv.ParseInt(string(text), 10, 64); err == nil {
+				return json.RawMessage(text), nil
+			}
+		}
+		return int64(v.Duration()), nil
+	}
+	return nil, errors.Errorf("unsupported value kind %s", v.Kind())
+}
@@ -0,0 +1,78 @@
+package apachelog
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// localAddr returns the local address on which the request was
+// received, as recorded by net/http. It returns nil if the address
+// is not available (e.g. the request did not go through http.Server)
+func localAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+func localHostPort(r *http.Request) (string, string) {
+	addr := localAddr(r)
+	if addr == nil {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", ""
+	}
+	return host, port
+}
+
+// portValue converts a port number to a Value
+func portValue(port string) Value {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return MissingValue()
+	}
+	return IntValue(int64(n))
+}
+
+var localIPAddr = newField(func(ctx LogCtx) Value {
+	host, _ := localHostPort(ctx.Request())
+	return stringOrMissing(host)
+})
+
+var localPort = newField(func(ctx LogCtx) Value {
+	_, port := localHostPort(ctx.Request())
+	return portValue(port)
+})
+
+var remotePort = newField(func(ctx LogCtx) Value {
+	_, port, err := net.SplitHostPort(ctx.Request().RemoteAddr)
+	if err != nil {
+		return MissingValue()
+	}
+	return portValue(port)
+})
+
+// makeCanonicalPort creates a Field for the canonical port of the
+// server. If serverPort is non-zero, it is always used. Otherwise
+// the port is taken from the Host header, then from the local address,
+// and finally the default port for the scheme is assumed
+func makeCanonicalPort(serverPort int) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		if serverPort > 0 {
+			return IntValue(int64(serverPort))
+		}
+
+		r := ctx.Request()
+		if _, p, err := net.SplitHostPort(r.Host); err == nil {
+			return portValue(p)
+		}
+		if _, p := localHostPort(r); p != "" {
+			return portValue(p)
+		}
+		if r.TLS != nil {
+			return IntValue(443)
+		}
+		return IntValue(80)
+	})
+}
@@ -1,9 +1,11 @@
 package apachelog
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/lestrrat-go/apache-logformat/v2/internal/httputil"
 	"github.com/lestrrat-go/apache-logformat/v2/internal/logctx"
@@ -12,13 +14,53 @@ import (
 
 // New creates a new ApacheLog instance from the given
 // format. It will return an error if the format fails to compile.
-func New(format string) (*ApacheLog, error) {
-	var f Format
-	if err := f.compile(format); err != nil {
-		return nil, errors.Wrap(err, "failed to compile log format")
+func New(format string, options ...Option) (*ApacheLog, error) {
+	f, err := newFormat(format, options)
+	if err != nil {
+		return nil, err
 	}
+	return newApacheLog(f, f.Warnings(), f.needs, options), nil
+}
+
+// newApacheLog creates a new ApacheLog that writes lines using format.
+// warnings are the problems found while compiling format, and needs is
+// the per-request state that it logs. The options that apply to the
+// ApacheLog itself, rather than to the format, are handled here
+func newApacheLog(format FormatWriter, warnings []*CompileError, needs need, options []Option) *ApacheLog {
+	al := ApacheLog{format: format, needs: needs, warnings: warnings}
+	for _, o := range options {
+		switch o.Name() {
+		case optkeyChildSpan:
+			al.childSpan = o.Value().(bool)
+		case optkeyClock:
+			al.clock = o.Value().(Clock)
+		case optkeyErrorHandler:
+			al.errorHandler = o.Value().(func(error, *http.Request))
+		case optkeyRequestIDGenerator:
+			al.requestIDGenerator = o.Value().(RequestIDGenerator)
+		case optkeyRequestIDHeader:
+			al.requestIDHeader = o.Value().(string)
+		case optkeyRequestIDResponseHeader:
+			al.requestIDResponseHeader = o.Value().(string)
+		}
+	}
+
+	if al.requestIDGenerator == nil {
+		al.requestIDGenerator = NewUUIDv7Generator()
+	}
+
+	if al.errorHandler == nil {
+		al.errorHandler = NewRateLimitedErrorHandler(os.Stderr, time.Second).Handle
+	}
+	return &al
+}
 
-	return &ApacheLog{format: &f}, nil
+// Warnings returns the problems that were found, and worked around,
+// while compiling the format(s) of the ApacheLog, such as unknown
+// directives that were ignored. See WithStrictCompile to reject such
+// formats instead
+func (al *ApacheLog) Warnings() []*CompileError {
+	return al.warnings
 }
 
 // WriteLog generates a log line using the format associated with the
@@ -33,7 +75,7 @@ func (al *ApacheLog) WriteLog(dst io.Writer, ctx LogCtx) error {
 	}
 
 	b := buf.Bytes()
-	if b[len(b)-1] != '\n' {
+	if len(b) == 0 || b[len(b)-1] != '\n' {
 		buf.WriteByte('\n')
 	}
 
@@ -44,24 +86,126 @@ func (al *ApacheLog) WriteLog(dst io.Writer, ctx LogCtx) error {
 }
 
 // Wrap creates a new http.Handler that logs a formatted log line
-// to dst.
+// to dst. The handler receives a request whose context can store
+// notes set via SetNote, and carries the request ID (see
+// RequestIDFromContext).
+//
+// Only the state that the format logs is set up for each request: for
+// example, notes can only be set via SetNote if the format logs them
+// using %{...}n.
+//
+// If the handler hijacks the connection, e.g. to serve a websocket,
+// the log line is written when the hijacked connection is closed. It
+// is logged with status 101, the number of bytes written to the
+// connection, and the time elapsed until the connection was closed.
+// Nothing is logged for hijacked connections that are never closed.
+//
+// If the format logs %I, %O or %S, and the server counts the bytes of
+// its connections using a ConnTracker, the log line of HTTP/1.x
+// requests is written once the response has been sent to the client,
+// with the number of bytes that were actually transferred
 func (al *ApacheLog) Wrap(h http.Handler, dst io.Writer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := logctx.Get(r)
-		defer logctx.Release(ctx)
+		if nctx := al.requestContext(w, r); nctx != r.Context() {
+			r = r.WithContext(nctx)
+		}
+
+		var ctx *logctx.Context
+		if al.clock != nil {
+			ctx = logctx.GetWithClock(r, al.clock)
+		} else {
+			ctx = logctx.Get(r)
+		}
+		if al.needs&needRequestBody != 0 {
+			ctx.CountBody()
+		}
 
 		wrapped := httputil.GetResponseWriter(w)
-		defer httputil.ReleaseResponseWriter(wrapped)
+		if al.needs&needResponseHeader != 0 {
+			wrapped.SnapshotHeader()
+		}
 
 		defer func() {
+			if conn := wrapped.Hijacked(); conn != nil {
+				header := wrapped.SentHeader()
+				httputil.ReleaseResponseWriter(wrapped)
+				conn.OnClose(func() {
+					defer logctx.Release(ctx)
+					ctx.FinalizeHijacked(header, conn)
+					al.writeLog(dst, ctx, r)
+				})
+				return
+			}
+
 			ctx.Finalize(wrapped)
-			if err := al.WriteLog(dst, ctx); err != nil {
-				// Hmmm... no where to log except for stderr
-				os.Stderr.Write([]byte(err.Error()))
+			httputil.ReleaseResponseWriter(wrapped)
+			if requestAborted(r) {
+				ctx.SetAborted()
+			}
+
+			// If the bytes are logged and counted on the connection, the
+			// line is written once the response has been completely sent
+			if al.needs&needTransferred != 0 && afterResponseSent(r, func(received, sent int64) {
+				defer logctx.Release(ctx)
+				ctx.SetTransferred(received, sent)
+				al.writeLog(dst, ctx, r)
+			}) {
 				return
 			}
+
+			defer logctx.Release(ctx)
+			al.writeLog(dst, ctx, r)
 		}()
 
-		h.ServeHTTP(wrapped, r)
+		h.ServeHTTP(httputil.Expose(wrapped), r)
 	})
 }
+
+// requestContext returns the context for the request r. Depending on
+// what the format logs, it can store notes and carries the request ID,
+// the number of keep-alive requests if the connection is tracked, as
+// well as the child span if requested. If r was already wrapped by
+// another ApacheLog, the existing values are reused. If nothing is
+// needed, the context of r is returned as is
+func (al *ApacheLog) requestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	ctx := r.Context()
+	if al.needs&needNotes != 0 {
+		ctx = ContextWithNotes(ctx)
+	}
+
+	if al.needs&needRequestID != 0 || al.requestIDResponseHeader != "" {
+		rid, ok := ctx.Value(requestIDKey{}).(*requestID)
+		if !ok {
+			rid = &requestID{generator: al.requestIDGenerator}
+			if al.requestIDHeader != "" {
+				if v := r.Header.Get(al.requestIDHeader); validRequestID(v) {
+					rid.id = v
+				}
+			}
+			ctx = context.WithValue(ctx, requestIDKey{}, rid)
+		}
+
+		if al.requestIDResponseHeader != "" {
+			w.Header().Set(al.requestIDResponseHeader, rid.get())
+		}
+	}
+
+	if al.needs&needKeepAliveCount != 0 {
+		ctx = withKeepAliveCount(ctx, r)
+	}
+
+	if al.childSpan && al.needs&needTraceContext != 0 {
+		if _, ok := ctx.Value(traceContextKey{}).(*traceContext); !ok {
+			ctx = context.WithValue(ctx, traceContextKey{}, newChildSpan(r))
+		}
+	}
+	return ctx
+}
+
+// writeLog writes the log line for ctx, and reports any error to the
+// error handler
+func (al *ApacheLog) writeLog(dst io.Writer, ctx LogCtx, r *http.Request) {
+	if err := al.WriteLog(dst, ctx); err != nil {
+		al.errorHandler(err, r)
+	}
+}
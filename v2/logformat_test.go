@@ -1,12 +1,20 @@
 package apachelog_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -16,6 +24,7 @@ import (
 	apachelog "github.com/lestrrat-go/apache-logformat/v2"
 	"github.com/lestrrat-go/apache-logformat/v2/internal/logctx"
 	strftime "github.com/lestrrat-go/strftime"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -173,7 +182,7 @@ func TestElapsed(t *testing.T) {
 	)
 
 	_, err := apachelog.New(`%{h}T`)
-	assert.EqualError(t, err, "failed to compile log format: unrecognised elapsed time unit: h")
+	assert.EqualError(t, err, "failed to compile log format: offset 0: %{h}T: unrecognised elapsed time unit: h (use one of s, ms, us)")
 }
 
 func TestElapsedTimeFraction(t *testing.T) {
@@ -227,14 +236,54 @@ func TestPercentS(t *testing.T) {
 
 func TestPid(t *testing.T) {
 	testLog(t,
-		`%p`, // pid
-		strconv.Itoa(os.Getpid())+"\n",
+		`%P %{pid}P`,
+		strconv.Itoa(os.Getpid())+" "+strconv.Itoa(os.Getpid())+"\n",
 		hello,
 		nil,
 		nil,
 	)
 }
 
+func TestLocalAddressAndPort(t *testing.T) {
+	l, err := apachelog.New(`%A %p %{local}p %{canonical}p %{remote}p`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	s := newServer(l, hello, &buf)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+
+	r, err := http.NewRequest("GET", s.URL, nil)
+	if !assert.NoError(t, err, "request creation should succeed") {
+		return
+	}
+	r.Host = "example.com:8443"
+
+	_, err = http.DefaultClient.Do(r)
+	if !assert.NoError(t, err, "GET should succeed") {
+		return
+	}
+
+	expected := fmt.Sprintf(`^127\.0\.0\.1 8443 %s 8443 \d+\n$`, u.Port())
+	assert.Regexp(t, expected, buf.String())
+
+	l, err = apachelog.New(`%p`, apachelog.WithServerPort(80))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+	buf.Reset()
+	if !assert.NoError(t, l.WriteLog(&buf, &Context{request: r}), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, "80\n", buf.String())
+}
+
 func TestUnknownAfterPecentGreaterThan(t *testing.T) {
 	testLog(t,
 		`%>X should be verbatim`, // %> followed by unknown char
@@ -334,7 +383,8 @@ func TestEnvironmentVariable(t *testing.T) {
 		vs := strings.SplitN(v, "=", 2)
 
 		t.Logf("Testing environment variable %s", vs[0])
-		al, err := apachelog.New(fmt.Sprintf(`%%{%s}e`, vs[0]))
+		// Values are written verbatim, as escaping is tested separately
+		al, err := apachelog.New(fmt.Sprintf(`%%{%s}e`, vs[0]), apachelog.WithEscape(false))
 		if !assert.NoError(t, err, "apachelog.New should succeed") {
 			return
 		}
@@ -356,6 +406,401 @@ func TestEnvironmentVariable(t *testing.T) {
 	}
 }
 
+func TestEscape(t *testing.T) {
+	r := &http.Request{
+		Method: "GET",
+		Proto:  "HTTP/1.1",
+		URL:    &url.URL{Path: "/"},
+		Header: http.Header{
+			"User-Agent": {"evil\" \"forged\\\n127.0.0.1 \x01\xff"},
+		},
+	}
+	ctx := &Context{request: r}
+
+	al, err := apachelog.New(`"%r" "%{User-Agent}i"`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, `"GET / HTTP/1.1" "evil\" \"forged\\\n127.0.0.1 \x01\xff"`+"\n", buf.String())
+
+	p, err := apachelog.NewParser(`"%r" "%{User-Agent}i"`)
+	if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+		return
+	}
+	rec, err := p.Parse(buf.String())
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	assert.Equal(t, r.Header.Get("User-Agent"), rec.RequestHeader.Get("User-Agent"))
+
+	al, err = apachelog.New(`%{User-Agent}i`, apachelog.WithEscape(false))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	buf.Reset()
+	if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, r.Header.Get("User-Agent")+"\n", buf.String())
+}
+
+func TestJSON(t *testing.T) {
+	al, err := apachelog.NewJSON(map[string]string{
+		"remote_addr":  "%h",
+		"request":      "%m %U",
+		"request_time": "%t",
+		"status":       "%>s",
+		"bytes":        "%b",
+		"referer":      "%{Referer}i",
+		"user_agent":   "%{User-Agent}i",
+	})
+	if !assert.NoError(t, err, "apachelog.NewJSON should succeed") {
+		return
+	}
+
+	ctx := &Context{
+		request: &http.Request{
+			Method:     "GET",
+			RemoteAddr: "127.0.0.1:51111",
+			URL:        &url.URL{Path: "/foo"},
+			Header: http.Header{
+				"User-Agent": {`Fancy "Agent"`},
+			},
+		},
+		requestTime:    time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC),
+		responseStatus: http.StatusNoContent,
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, `{"bytes":null,"referer":null,"remote_addr":"127.0.0.1","request":"GET /foo","request_time":"2020-09-29T12:34:56Z","status":204,"user_agent":"Fancy \"Agent\""}`+"\n", buf.String())
+
+	ctx.responseContentLength = 42
+	buf.Reset()
+	if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+	assert.Contains(t, buf.String(), `"bytes":42,`)
+
+	t.Run("Time format", func(t *testing.T) {
+		al, err := apachelog.NewJSON(map[string]string{
+			"day":   "%{%Y-%m-%d}t",
+			"begin": "%{begin:%H:%M:%S}t",
+			"end":   "%{end:%H:%M:%S}t",
+		})
+		if !assert.NoError(t, err, "apachelog.NewJSON should succeed") {
+			return
+		}
+
+		ctx.responseTime = ctx.requestTime.Add(time.Second)
+		buf.Reset()
+		if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, `{"begin":"12:34:56","day":"2020-09-29","end":"12:34:57"}`+"\n", buf.String(), "times should be written in their own format")
+	})
+}
+
+func TestFormatValues(t *testing.T) {
+	f, err := apachelog.NewFormat(`%h %t "%r" %>s %b %D %{Referer}i`)
+	if !assert.NoError(t, err, "apachelog.NewFormat should succeed") {
+		return
+	}
+
+	requestTime := time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC)
+	ctx := &Context{
+		elapsedTime: 1500 * time.Microsecond,
+		request: &http.Request{
+			Method:     "GET",
+			Proto:      "HTTP/1.1",
+			RemoteAddr: "127.0.0.1:51111",
+			URL:        &url.URL{Path: "/"},
+			Header:     http.Header{},
+		},
+		requestTime:    requestTime,
+		responseStatus: http.StatusOK,
+	}
+
+	values := f.Values(ctx)
+	if !assert.Len(t, values, 7, "expected one value per directive") {
+		return
+	}
+
+	expected := []struct {
+		Directive string
+		Kind      apachelog.Kind
+	}{
+		{"%h", apachelog.KindString},
+		{"%t", apachelog.KindTime},
+		{"%r", apachelog.KindString},
+		{"%>s", apachelog.KindInt},
+		{"%b", apachelog.KindMissing},
+		{"%D", apachelog.KindDuration},
+		{"%{Referer}i", apachelog.KindMissing},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.Directive, values[i].Directive)
+		assert.Equal(t, e.Kind, values[i].Value.Kind(), "kind for %s", e.Directive)
+	}
+
+	assert.Equal(t, "127.0.0.1", values[0].Value.String())
+	assert.True(t, requestTime.Equal(values[1].Value.Time()), "request time should match")
+	assert.Equal(t, int64(http.StatusOK), values[3].Value.Int())
+	assert.Equal(t, 1500*time.Microsecond, values[5].Value.Duration())
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, f.WriteTo(&buf, ctx), "WriteTo should succeed") {
+		return
+	}
+	assert.Equal(t, `127.0.0.1 [29/Sep/2020:12:34:56 +0000] "GET / HTTP/1.1" 200 - 1500 -`, buf.String())
+}
+
+func TestLTSV(t *testing.T) {
+	al, err := apachelog.NewLTSV(map[string]string{
+		"host":   "%h",
+		"req":    "%m %U",
+		"status": "%>s",
+		"size":   "%b",
+		"ua":     "%{User-Agent}i",
+	})
+	if !assert.NoError(t, err, "apachelog.NewLTSV should succeed") {
+		return
+	}
+
+	ctx := &Context{
+		request: &http.Request{
+			Method:     "GET",
+			RemoteAddr: "127.0.0.1:51111",
+			URL:        &url.URL{Path: "/foo"},
+			Header: http.Header{
+				"User-Agent": {"tab\there: colon\\"},
+			},
+		},
+		responseStatus: http.StatusOK,
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, "host:127.0.0.1\treq:GET /foo\tsize:-\tstatus:200\tua:tab\\there: colon\\\\\n", buf.String())
+
+	_, err = apachelog.NewLTSV(map[string]string{"bad label": "%h"})
+	assert.Error(t, err, "invalid labels should be rejected")
+}
+
+func TestLogfmt(t *testing.T) {
+	al, err := apachelog.NewLogfmt(map[string]string{
+		"host":   "%h",
+		"req":    "%m %U",
+		"status": "%>s",
+		"ua":     "%{User-Agent}i",
+		"user":   "%u",
+	})
+	if !assert.NoError(t, err, "apachelog.NewLogfmt should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	s := newServer(al, hello, &buf)
+	defer s.Close()
+
+	r, err := http.NewRequest("GET", s.URL+"/foo", nil)
+	if !assert.NoError(t, err, "request creation should succeed") {
+		return
+	}
+	r.Header.Set("User-Agent", `say "hi"`)
+
+	_, err = http.DefaultClient.Do(r)
+	if !assert.NoError(t, err, "GET should succeed") {
+		return
+	}
+	assert.Equal(t, `host=127.0.0.1 req="GET /foo" status=200 ua="say \"hi\"" user=-`+"\n", buf.String())
+
+	_, err = apachelog.NewLogfmt(map[string]string{"a=b": "%h"})
+	assert.Error(t, err, "invalid keys should be rejected")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestErrorHandler(t *testing.T) {
+	var handled []string
+	al, err := apachelog.New(`%m %U`, apachelog.WithErrorHandler(func(err error, r *http.Request) {
+		handled = append(handled, r.URL.Path+": "+err.Error())
+	}))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	h := al.Wrap(hello, failingWriter{})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+
+	assert.Equal(t, []string{"/foo: failed to write formated line to destination: disk full"}, handled)
+}
+
+func TestRateLimitedErrorHandler(t *testing.T) {
+	var buf bytes.Buffer
+	eh := apachelog.NewRateLimitedErrorHandler(&buf, time.Hour)
+
+	al, err := apachelog.New(`%m %U`, apachelog.WithErrorHandler(eh.Handle))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	h := al.Wrap(hello, failingWriter{})
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	}
+
+	assert.Equal(t, uint64(3), eh.Count())
+	assert.Equal(t, "apachelog: failed to write log line for GET /foo: failed to write formated line to destination: disk full\n", buf.String())
+}
+
+func TestPerInstanceOptions(t *testing.T) {
+	cl := clock.NewMock()
+	cl.Add(time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC).Sub(cl.Now()))
+
+	loc := time.FixedZone("JST", 9*60*60)
+	al, err := apachelog.New(`%t %D %u %{Referer}i`,
+		apachelog.WithClock(cl),
+		apachelog.WithLocation(loc),
+		apachelog.WithMissingValue("?"),
+	)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	h := al.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cl.Add(2 * time.Millisecond)
+	}), &buf)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, "[29/Sep/2020:21:34:56 +0900] 2000 ? ?\n", buf.String())
+}
+
+func TestEmptyMissingValue(t *testing.T) {
+	al, err := apachelog.New(`%{X-Foo}i`, apachelog.WithMissingValue(""))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	h := al.Wrap(http.HandlerFunc(hello), &buf)
+	if !assert.NotPanics(t, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}, "logging an empty line should not panic") {
+		return
+	}
+	assert.Equal(t, "\n", buf.String(), "an empty line should be logged")
+}
+
+func TestStrictCompile(t *testing.T) {
+	formats := []string{
+		`%Z`,
+		`%>X`,
+		`%{Referer`,
+		`stray %`,
+		`%{Referer}I`,
+		`%{x}h`,
+	}
+
+	for _, format := range formats {
+		_, err := apachelog.New(format)
+		assert.NoError(t, err, "lenient compile of %q should succeed", format)
+
+		_, err = apachelog.New(format, apachelog.WithStrictCompile(true))
+		assert.Error(t, err, "strict compile of %q should fail", format)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	testcases := []struct {
+		format     string
+		offset     int
+		directive  string
+		suggestion string
+	}{
+		{`%h %Z`, 3, `%Z`, ""},
+		{`100% sure`, 3, `% `, "use %% for a literal percent sign"},
+		{`%h %M`, 3, `%M`, "did you mean %m?"},
+		{`%h %>X`, 3, `%>`, "use %>s for the final status, or %% for a literal percent sign"},
+		{`%h "%{Referer`, 4, `%{Referer`, "close the block with '}' followed by a directive, e.g. %{Referer}i"},
+		{`100%`, 3, `%`, "use %% for a literal percent sign"},
+		{`%h %{Referer}I`, 3, `%{Referer}I`, "did you mean %{Referer}i?"},
+		{`%{x}h`, 0, `%{x}h`, "use %h without a key"},
+	}
+
+	for _, tc := range testcases {
+		al, err := apachelog.New(tc.format)
+		if !assert.NoError(t, err, "lenient compile of %q should succeed", tc.format) {
+			return
+		}
+		warnings := al.Warnings()
+		if !assert.Len(t, warnings, 1, "%q should produce a warning", tc.format) {
+			return
+		}
+		assert.Equal(t, tc.offset, warnings[0].Offset, "offset for %q should match", tc.format)
+		assert.Equal(t, tc.directive, warnings[0].Directive, "directive for %q should match", tc.format)
+		assert.Equal(t, tc.suggestion, warnings[0].Suggestion, "suggestion for %q should match", tc.format)
+
+		_, err = apachelog.New(tc.format, apachelog.WithStrictCompile(true))
+		ce, ok := errors.Cause(err).(*apachelog.CompileError)
+		if !assert.True(t, ok, "strict compile of %q should fail with a CompileError", tc.format) {
+			return
+		}
+		assert.Equal(t, tc.offset, ce.Offset, "offset for %q should match", tc.format)
+	}
+
+	t.Run("Unknown block directive", func(t *testing.T) {
+		_, err := apachelog.New(`%h %{Referer}z`)
+		ce, ok := errors.Cause(err).(*apachelog.CompileError)
+		if !assert.True(t, ok, "error should be a CompileError") {
+			return
+		}
+		assert.Equal(t, 3, ce.Offset, "offset should match")
+		assert.Equal(t, `%{Referer}z`, ce.Directive, "directive should match")
+		assert.Equal(t, apachelog.ErrUnimplemented, errors.Cause(ce.Err), "cause should be ErrUnimplemented")
+		assert.Equal(t, "use %{Referer}i for a request header, or %{Referer}o for a response header", ce.Suggestion)
+	})
+
+	t.Run("Unexpected key", func(t *testing.T) {
+		f, err := apachelog.NewFormat(`%{x}h`)
+		if !assert.NoError(t, err, "lenient compile should succeed") {
+			return
+		}
+		values := f.Values(apachelog.NewEntry(nil))
+		if !assert.Len(t, values, 1, "the directive should be kept") {
+			return
+		}
+		assert.Equal(t, `%h`, values[0].Directive, "the key should be dropped")
+	})
+
+	t.Run("Clean format", func(t *testing.T) {
+		assert.Empty(t, apachelog.CombinedLog.Warnings(), "combined log should not have warnings")
+	})
+
+	t.Run("Structured encoder", func(t *testing.T) {
+		al, err := apachelog.NewJSON(map[string]string{"host": "%h", "bogus": "%Z"})
+		if !assert.NoError(t, err, "NewJSON should succeed") {
+			return
+		}
+		assert.Len(t, al.Warnings(), 1, "warnings from each field should be collected")
+	})
+}
+
 type Context struct {
 	elapsedTime           time.Duration
 	request               *http.Request
@@ -393,3 +838,1383 @@ func (ctx *Context) ResponseStatus() int {
 func (ctx *Context) ResponseTime() time.Time {
 	return ctx.responseTime
 }
+
+func TestEntry(t *testing.T) {
+	r, err := http.NewRequest("GET", "/replay?id=1", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("User-Agent", "replay/1.0")
+
+	start := time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC)
+	e := apachelog.NewEntry(r).
+		Status(http.StatusAccepted).
+		Bytes(42).
+		Times(start, start.Add(1500*time.Millisecond)).
+		Header(http.Header{"Content-Type": []string{"text/plain"}})
+
+	al, err := apachelog.New(`%h [%{%Y-%m-%d %H:%M:%S}t] "%r" %>s %b %D "%{User-Agent}i" %{Content-Type}o`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, al.WriteLog(&buf, e), "WriteLog should succeed") {
+		return
+	}
+	assert.Equal(t, `192.0.2.1 [2020-09-29 12:34:56] "GET /replay?id=1 HTTP/1.1" 202 42 1500000 "replay/1.0" text/plain`+"\n", buf.String())
+
+	t.Run("Empty entry", func(t *testing.T) {
+		var buf bytes.Buffer
+		if !assert.NoError(t, apachelog.CommonLog.WriteLog(&buf, apachelog.NewEntry(nil)), "WriteLog should succeed") {
+			return
+		}
+		assert.True(t, strings.HasPrefix(buf.String(), "- - - "), "missing values should be logged as dashes")
+	})
+
+	t.Run("Nil request", func(t *testing.T) {
+		al, err := apachelog.New(`"%m" "%H" "%r" "%U" "%{Referer}i"`)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(nil)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, `"" "" "-" "" "-"`+"\n", buf.String(), "request fields should be empty, and the request line and headers missing")
+	})
+
+	t.Run("Empty line", func(t *testing.T) {
+		al, err := apachelog.New(`%>s`)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(nil)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "\n", buf.String(), "an empty line should be logged")
+	})
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	type interfaces struct {
+		Flusher, Hijacker, ReaderFrom, CloseNotifier, Unwrap bool
+	}
+	check := func(w http.ResponseWriter) interfaces {
+		var v interfaces
+		_, v.Flusher = w.(http.Flusher)
+		_, v.Hijacker = w.(http.Hijacker)
+		_, v.ReaderFrom = w.(io.ReaderFrom)
+		_, v.CloseNotifier = w.(http.CloseNotifier)
+		_, v.Unwrap = w.(interface{ Unwrap() http.ResponseWriter })
+		return v
+	}
+
+	var got interfaces
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = check(w)
+		if rf, ok := w.(io.ReaderFrom); ok {
+			_, _ = rf.ReadFrom(strings.NewReader(message))
+		}
+	})
+
+	t.Run("Server connection", func(t *testing.T) {
+		var buf bytes.Buffer
+		s := newServer(apachelog.CommonLog, handler, &buf)
+		defer s.Close()
+
+		res, err := http.Get(s.URL)
+		if !assert.NoError(t, err, "GET should succeed") {
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, message, string(body), "body should be written via ReadFrom")
+		assert.Equal(t, interfaces{true, true, true, true, true}, got, "all interfaces of the server's writer should be exposed")
+		assert.True(t, strings.HasSuffix(buf.String(), " 200 "+strconv.Itoa(len(message))+"\n"), "bytes written via ReadFrom should be counted")
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		apachelog.CommonLog.Wrap(handler, ioutil.Discard).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, interfaces{Flusher: true, Unwrap: true}, got, "only the interfaces of the recorder should be exposed")
+	})
+}
+
+// notifyWriter is an io.Writer that signals each write on a channel
+type notifyWriter struct {
+	lines chan string
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.lines <- string(p)
+	return len(p), nil
+}
+
+func TestHijack(t *testing.T) {
+	const upgrade = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\n\r\n"
+
+	cl := clock.NewMock()
+	al, err := apachelog.New(`%>s %b %T`, apachelog.WithClock(cl))
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		_, _ = brw.WriteString(upgrade)
+		_ = brw.Flush()
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, brw)
+		}()
+	})
+
+	out := &notifyWriter{lines: make(chan string, 1)}
+	s := newServer(al, handler, out)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if !assert.NoError(t, err, "Dial should succeed") {
+		return
+	}
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\nping"))
+
+	buf := make([]byte, len(upgrade)+4)
+	if _, err := io.ReadFull(conn, buf); !assert.NoError(t, err, "reading the echo should succeed") {
+		return
+	}
+	assert.Equal(t, upgrade+"ping", string(buf), "data should be echoed")
+
+	select {
+	case line := <-out.lines:
+		t.Errorf("log line should not be written before the connection is closed: %q", line)
+		return
+	default:
+	}
+
+	cl.Add(5 * time.Second)
+	conn.Close()
+
+	select {
+	case line := <-out.lines:
+		assert.Equal(t, "101 "+strconv.Itoa(len(upgrade)+4)+" 5\n", line, "log line should cover the whole session")
+	case <-time.After(5 * time.Second):
+		t.Errorf("log line was not written after the connection was closed")
+	}
+}
+
+func TestBytesTransferred(t *testing.T) {
+	const request = "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"
+
+	const format = `%b %B %I %O %S`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	// The bytes are counted on the connection, so that they can be
+	// compared with what was actually transferred
+	out := &notifyWriter{lines: make(chan string, 1)}
+	s := httptest.NewUnstartedServer(al.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		hello.ServeHTTP(w, r)
+	}), out))
+	tracker := apachelog.NewConnTracker()
+	tracker.Install(s.Config)
+	s.Listener = tracker.Listener(s.Listener)
+	s.Start()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if !assert.NoError(t, err, "Dial should succeed") {
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(request))
+
+	// Capture the raw response, to compare against the logged size
+	var raw bytes.Buffer
+	res, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, &raw)), nil)
+	if !assert.NoError(t, err, "ReadResponse should succeed") {
+		return
+	}
+	_, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	var line string
+	select {
+	case line = <-out.lines:
+	case <-time.After(5 * time.Second):
+		t.Errorf("log line was not written")
+		return
+	}
+
+	sent := raw.Len()
+	expected := fmt.Sprintf("%d %d %d %d %d\n", len(message), len(message), len(request), sent, len(request)+sent)
+	if !assert.Equal(t, expected, line, "byte counts should match what was transferred") {
+		return
+	}
+
+	p, err := apachelog.NewParser(format)
+	if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+		return
+	}
+	rec, err := p.Parse(line)
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	assert.Equal(t, int64(len(request)), rec.BytesReceived, "BytesReceived should be parsed")
+	assert.Equal(t, int64(sent), rec.BytesSent, "BytesSent should be parsed")
+	assert.Equal(t, int64(len(request)+sent), rec.BytesTransferred, "BytesTransferred should be parsed")
+
+	t.Run("Empty body", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := apachelog.NewEntry(nil).Status(http.StatusNoContent).Transferred(100, 50)
+		if !assert.NoError(t, al.WriteLog(&buf, e), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "- 0 100 50 150\n", buf.String(), "%B should log 0 instead of -")
+	})
+}
+
+// writeCounter counts the bytes written to the connection that it wraps
+type writeCounter struct {
+	net.Conn
+	written int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += n
+	return n, err
+}
+
+func TestBytesTransferredTLS(t *testing.T) {
+	if _, ok := interface{}(&tls.Conn{}).(interface{ NetConn() net.Conn }); !ok {
+		t.Skip("tls.Conn does not expose the connection that it wraps")
+	}
+
+	const request = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	al, err := apachelog.New(`%I`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "apachelog")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Every connection on a unix socket has the same addresses, so they
+	// must not be used to tell connections apart
+	sock := filepath.Join(dir, "server.sock")
+	l, err := net.Listen("unix", sock)
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+
+	out := &notifyWriter{lines: make(chan string, 1)}
+	s := httptest.NewUnstartedServer(al.Wrap(hello, out))
+	tracker := apachelog.NewConnTracker()
+	tracker.Install(s.Config)
+	s.Listener.Close()
+	s.Listener = tracker.Listener(l)
+	s.StartTLS()
+	defer s.Close()
+
+	config := s.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "example.com"
+
+	var counters []*writeCounter
+	var conns []*tls.Conn
+	for i := 0; i < 2; i++ {
+		raw, err := net.Dial("unix", sock)
+		if !assert.NoError(t, err, "Dial should succeed") {
+			return
+		}
+		defer raw.Close()
+
+		wc := &writeCounter{Conn: raw}
+		conn := tls.Client(wc, config)
+		if !assert.NoError(t, conn.Handshake(), "Handshake should succeed") {
+			return
+		}
+		counters = append(counters, wc)
+		conns = append(conns, conn)
+	}
+
+	// Send the requests in the reverse order in which the connections
+	// were accepted, so that the counts of one can not be mistaken for
+	// the other
+	for i := len(conns) - 1; i >= 0; i-- {
+		_, _ = conns[i].Write([]byte(request))
+		res, err := http.ReadResponse(bufio.NewReader(conns[i]), nil)
+		if !assert.NoError(t, err, "ReadResponse should succeed") {
+			return
+		}
+		_, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		select {
+		case line := <-out.lines:
+			assert.Equal(t, fmt.Sprintf("%d\n", counters[i].written), line, "%I should count what was received on the connection, including TLS")
+		case <-time.After(5 * time.Second):
+			t.Errorf("log line was not written")
+			return
+		}
+	}
+}
+
+func TestBytesSent(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	cases := []struct {
+		Name    string
+		Request string
+		Handler http.HandlerFunc
+	}{
+		{
+			Name:    "Sniffed Content-Type",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("0123456789"))
+			},
+		},
+		{
+			Name:    "Chunked",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write(bytes.Repeat([]byte("x"), 10000))
+			},
+		},
+		{
+			Name:    "Chunked in small writes",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 30; i++ {
+					_, _ = w.Write(bytes.Repeat([]byte("x"), 100))
+				}
+			},
+		},
+		{
+			Name:    "Flushed",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("<html>"))
+				w.(http.Flusher).Flush()
+				_, _ = w.Write([]byte("</html>"))
+			},
+		},
+		{
+			Name:    "Trailer",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				_, _ = w.Write([]byte(message))
+				w.Header().Set("X-Checksum", "abc")
+			},
+		},
+		{
+			Name:    "No content",
+			Request: get,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			Name:    "Connection close",
+			Request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(bytes.Repeat([]byte("x"), 3000))
+			},
+		},
+	}
+
+	al, err := apachelog.New(`%I %O`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	for _, c := range cases {
+		c := c
+		for _, counted := range []bool{false, true} {
+			counted := counted
+			t.Run(fmt.Sprintf("%s (counted=%t)", c.Name, counted), func(t *testing.T) {
+				out := &notifyWriter{lines: make(chan string, 1)}
+				s := httptest.NewUnstartedServer(al.Wrap(c.Handler, out))
+				if counted {
+					tracker := apachelog.NewConnTracker()
+					tracker.Install(s.Config)
+					s.Listener = tracker.Listener(s.Listener)
+				}
+				s.Start()
+				defer s.Close()
+
+				conn, err := net.Dial("tcp", s.Listener.Addr().String())
+				if !assert.NoError(t, err, "Dial should succeed") {
+					return
+				}
+				defer conn.Close()
+				_, _ = conn.Write([]byte(c.Request))
+
+				var raw bytes.Buffer
+				res, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, &raw)), nil)
+				if !assert.NoError(t, err, "ReadResponse should succeed") {
+					return
+				}
+				_, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+
+				var line string
+				select {
+				case line = <-out.lines:
+				case <-time.After(5 * time.Second):
+					t.Errorf("log line was not written")
+					return
+				}
+
+				if counted {
+					assert.Equal(t, fmt.Sprintf("%d %d\n", len(c.Request), raw.Len()), line, "byte counts should match what was transferred")
+					return
+				}
+
+				// Estimates do not account for everything that net/http
+				// does, such as chunking, so they are only expected to
+				// be close to what was transferred
+				var received, sent int
+				if _, err := fmt.Sscanf(line, "%d %d\n", &received, &sent); !assert.NoError(t, err, "log line should contain two numbers") {
+					return
+				}
+				assert.Equal(t, len(c.Request), received, "request size should be estimated from its headers")
+				assert.InDelta(t, raw.Len(), sent, 100, "response size should be close to what was transferred")
+			})
+		}
+	}
+
+	t.Run("Estimate", func(t *testing.T) {
+		const header = "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Date: Tue, 29 Sep 2020 12:34:56 GMT\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n"
+
+		al, err := apachelog.New(`%O`)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+
+		var buf bytes.Buffer
+		e := apachelog.NewEntry(nil).
+			Status(http.StatusOK).
+			Bytes(int64(len(message))).
+			Header(http.Header{"Content-Type": {"text/plain"}})
+		if !assert.NoError(t, al.WriteLog(&buf, e), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, strconv.Itoa(len(header)+len(message))+"\n", buf.String(), "estimates should account for the headers added by net/http")
+	})
+}
+
+func TestDeferredLog(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Format   string
+		Install  func(*apachelog.ConnTracker, *http.Server)
+		Deferred bool
+	}{
+		{
+			Name:     "Byte counts",
+			Format:   `%O`,
+			Install:  (*apachelog.ConnTracker).Install,
+			Deferred: true,
+		},
+		{
+			Name:    "No byte counts",
+			Format:  `%>s`,
+			Install: (*apachelog.ConnTracker).Install,
+		},
+		{
+			Name:   "ConnContext only",
+			Format: `%O`,
+			Install: func(tracker *apachelog.ConnTracker, srv *http.Server) {
+				srv.ConnContext = tracker.ConnContext
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			al, err := apachelog.New(c.Format)
+			if !assert.NoError(t, err, "apachelog.New should succeed") {
+				return
+			}
+
+			// written reports if the line was written by the time the
+			// wrapped handler returned
+			out := &notifyWriter{lines: make(chan string, 1)}
+			written := make(chan bool, 1)
+			wrapped := al.Wrap(hello, out)
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wrapped.ServeHTTP(w, r)
+				written <- len(out.lines) > 0
+			}))
+			tracker := apachelog.NewConnTracker()
+			c.Install(tracker, s.Config)
+			s.Listener = tracker.Listener(s.Listener)
+			s.Start()
+			defer s.Close()
+
+			res, err := http.Get(s.URL)
+			if !assert.NoError(t, err, "GET should succeed") {
+				return
+			}
+			_, _ = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+
+			assert.Equal(t, !c.Deferred, <-written, "log line should only be deferred when byte counts are logged")
+			select {
+			case <-out.lines:
+			case <-time.After(5 * time.Second):
+				t.Errorf("log line was not written")
+			}
+		})
+	}
+}
+
+func TestStatusCondition(t *testing.T) {
+	const format = `%400,501{User-agent}i %!200,304,302{Referer}i %404U %!200t`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+	if !assert.Empty(t, al.Warnings(), "status conditions should compile without warnings") {
+		return
+	}
+
+	r, err := http.NewRequest("GET", "/missing", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	r.Header.Set("User-Agent", "test/1.0")
+	r.Header.Set("Referer", "http://example.com/")
+	start := time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC)
+
+	testcases := []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusOK, "- - - -\n"},
+		{http.StatusBadRequest, "test/1.0 http://example.com/ - [29/Sep/2020:12:34:56 +0000]\n"},
+		{http.StatusNotFound, "- http://example.com/ /missing [29/Sep/2020:12:34:56 +0000]\n"},
+		{http.StatusFound, "- - - [29/Sep/2020:12:34:56 +0000]\n"},
+	}
+	for _, tc := range testcases {
+		var buf bytes.Buffer
+		e := apachelog.NewEntry(r).Status(tc.status).Times(start, start)
+		if !assert.NoError(t, al.WriteLog(&buf, e), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, tc.expected, buf.String(), "log line for status %d should match", tc.status)
+	}
+
+	t.Run("Parse", func(t *testing.T) {
+		p, err := apachelog.NewParser(format)
+		if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+			return
+		}
+		rec, err := p.Parse("- http://example.com/ /missing -\n")
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		assert.Equal(t, "http://example.com/", rec.RequestHeader.Get("Referer"))
+		assert.Equal(t, "/missing", rec.Path)
+		assert.Equal(t, "/missing", rec.Fields["%404U"], "fields should be keyed by the directive including the condition")
+	})
+
+	t.Run("Invalid condition", func(t *testing.T) {
+		for _, format := range []string{`%!{Referer}i`, `%400,{Referer}i`, `%400`, `%400%`} {
+			_, err := apachelog.New(format, apachelog.WithStrictCompile(true))
+			_, ok := errors.Cause(err).(*apachelog.CompileError)
+			assert.True(t, ok, "strict compile of %q should fail with a CompileError", format)
+		}
+	})
+
+	t.Run("Literal percent sign", func(t *testing.T) {
+		al, err := apachelog.New(`100%400%`)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+		if assert.Len(t, al.Warnings(), 1, "a warning should be reported") {
+			assert.Equal(t, 3, al.Warnings()[0].Offset, "the warning should point at the status condition")
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(nil)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "100%\n", buf.String(), "the condition should be dropped")
+	})
+}
+
+func TestOriginalAndFinalStatus(t *testing.T) {
+	const format = `%s %<s %>s %{1xx}s %{superfluous}s`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	testcases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{
+			name:     "Implicit status",
+			handler:  func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte(message)) },
+			expected: "200 200 200 - -\n",
+		},
+		{
+			name: "Rewritten status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Link", "</style.css>; rel=preload")
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusNotFound)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expected: "404 404 404 103 500\n",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			al.Wrap(tc.handler, &buf).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if !assert.Equal(t, tc.expected, buf.String(), "statuses should be logged") {
+				return
+			}
+
+			p, err := apachelog.NewParser(format)
+			if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+				return
+			}
+			rec, err := p.Parse(buf.String())
+			if !assert.NoError(t, err, "Parse should succeed") {
+				return
+			}
+			assert.Equal(t, strings.Fields(tc.expected)[0], strconv.Itoa(rec.OriginalStatus), "original status should be parsed")
+			assert.Equal(t, strings.Fields(tc.expected)[2], strconv.Itoa(rec.ResponseStatus), "final status should be parsed")
+		})
+	}
+}
+
+func TestHeaderSnapshotAndTrailers(t *testing.T) {
+	const format = `%{X-Before}o %{X-After}o %{X-Checksum}o %{X-Checksum}^to %{X-Late}^to %{X-Client}^ti`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	out := &notifyWriter{lines: make(chan string, 1)}
+	s := newServer(al, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+
+		w.Header().Set("X-Before", "sent")
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte(message))
+
+		// None of these are sent as headers
+		w.Header().Set("X-Before", "changed")
+		w.Header().Set("X-After", "never sent")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	}), out)
+	defer s.Close()
+
+	r, err := http.NewRequest("POST", s.URL, ioutil.NopCloser(strings.NewReader("payload")))
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	r.ContentLength = -1
+	r.Trailer = http.Header{"X-Client": []string{"sum"}}
+
+	res, err := http.DefaultClient.Do(r)
+	if !assert.NoError(t, err, "request should succeed") {
+		return
+	}
+	_, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !assert.Equal(t, "abc", res.Trailer.Get("X-Checksum"), "trailer should be sent") {
+		return
+	}
+
+	select {
+	case line := <-out.lines:
+		assert.Equal(t, "sent - - abc yes sum\n", line, "headers should be logged as sent, and trailers separately")
+
+		p, err := apachelog.NewParser(format)
+		if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+			return
+		}
+		rec, err := p.Parse(line)
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		assert.Equal(t, "abc", rec.ResponseTrailer.Get("X-Checksum"), "response trailer should be parsed")
+		assert.Equal(t, "sum", rec.RequestTrailer.Get("X-Client"), "request trailer should be parsed")
+	case <-time.After(5 * time.Second):
+		t.Errorf("log line was not written")
+	}
+}
+
+func TestCookie(t *testing.T) {
+	const format = `%{session}C "%{theme}C" %{missing}C %{set:session}C %{set:theme}C`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	r.Header.Add("Cookie", `bogus; theme="dark mode"; session=first`)
+	r.Header.Add("Cookie", "session=second; =novalue")
+
+	h := http.Header{}
+	h.Add("Set-Cookie", "session=old; Path=/; HttpOnly")
+	h.Add("Set-Cookie", "session=new; Path=/; Secure")
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r).Status(http.StatusOK).Header(h)), "WriteLog should succeed") {
+		return
+	}
+	if !assert.Equal(t, "first \"dark mode\" - new -\n", buf.String(), "cookies should be logged") {
+		return
+	}
+
+	p, err := apachelog.NewParser(format)
+	if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+		return
+	}
+	rec, err := p.Parse(buf.String())
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	assert.Equal(t, "first", rec.Cookie["session"], "request cookie should be parsed")
+	assert.Equal(t, "dark mode", rec.Cookie["theme"], "quoted cookie should be parsed")
+	assert.Equal(t, "new", rec.SetCookie["session"], "response cookie should be parsed")
+
+	_, err = apachelog.New(`%C`)
+	ce, ok := errors.Cause(err).(*apachelog.CompileError)
+	if !assert.True(t, ok, "%C without a cookie name should fail with a CompileError") {
+		return
+	}
+	assert.Equal(t, "use %{name}C for a request cookie, or %{set:name}C for a cookie set by the response", ce.Suggestion)
+}
+
+func TestWrapSetsUpOnlyWhatIsLogged(t *testing.T) {
+	al, err := apachelog.New(`%h %>s %b`)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+	ctx, body := r.Context(), r.Body
+
+	var buf bytes.Buffer
+	h := al.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, r.Context() == ctx, "the request context should be left as is")
+		assert.True(t, r.Body == body, "the request body should not be counted")
+
+		apachelog.SetNote(r.Context(), "key", "value")
+		_, ok := apachelog.GetNote(r.Context(), "key")
+		assert.False(t, ok, "notes should not be stored")
+		_, ok = apachelog.RequestIDFromContext(r.Context())
+		assert.False(t, ok, "no request ID should be set up")
+		w.WriteHeader(http.StatusNoContent)
+	}), &buf)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equal(t, "192.0.2.1 204 -\n", buf.String(), "log line should match")
+}
+
+func TestNotes(t *testing.T) {
+	const format = `%{user_id}n %{missing}n "%{X-User-Id}o"`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apachelog.SetNote(r.Context(), "user_id", "42")
+		_, _ = w.Write([]byte(message))
+	})
+	// Notes set by inner handlers should be visible to outer loggers
+	outer := al.Wrap(apachelog.CommonLog.Wrap(handler, ioutil.Discard), &buf)
+
+	rec := httptest.NewRecorder()
+	outer.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "42 - \"-\"\n", buf.String(), "note should be logged")
+	assert.Empty(t, rec.Header().Get("X-User-Id"), "notes should not leak into the response")
+
+	t.Run("Entry", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(apachelog.ContextWithNotes(r.Context()))
+		apachelog.SetNote(r.Context(), "user_id", "43")
+
+		v, ok := apachelog.GetNote(r.Context(), "user_id")
+		assert.True(t, ok, "note should be set")
+		assert.Equal(t, "43", v, "note should be readable")
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "43 - \"-\"\n", buf.String(), "note should be logged")
+
+		p, err := apachelog.NewParser(format)
+		if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+			return
+		}
+		parsed, err := p.Parse(buf.String())
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		assert.Equal(t, "43", parsed.Notes["user_id"], "note should be parsed")
+	})
+
+	t.Run("No store", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		apachelog.SetNote(r.Context(), "user_id", "44")
+		_, ok := apachelog.GetNote(r.Context(), "user_id")
+		assert.False(t, ok, "notes should be discarded without a store")
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	t.Run("Generators", func(t *testing.T) {
+		uuid := apachelog.NewUUIDv7Generator().NewRequestID()
+		assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, uuid, "should be a UUIDv7")
+
+		ulid := apachelog.NewULIDGenerator().NewRequestID()
+		assert.Regexp(t, `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`, ulid, "should be a ULID")
+
+		assert.NotEqual(t, uuid, apachelog.NewUUIDv7Generator().NewRequestID(), "IDs should be unique")
+
+		g := apachelog.NewUniqueIDGenerator()
+		uniqueID := g.NewRequestID()
+		assert.Regexp(t, `^[A-Za-z0-9@-]{27}$`, uniqueID, "should be a mod_unique_id ID")
+		assert.NotEqual(t, uniqueID, g.NewRequestID(), "IDs should be unique")
+	})
+
+	const format = `%L %{UNIQUE_ID}e`
+	generator := apachelog.RequestIDGeneratorFunc(func() string { return "generated" })
+
+	testcases := []struct {
+		name     string
+		incoming string
+		expected string
+	}{
+		{"Generated", "", "generated"},
+		{"Trusted header", "abc-123", "abc-123"},
+		{"Invalid header", "abc 123", "generated"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			al, err := apachelog.New(format,
+				apachelog.WithRequestIDGenerator(generator),
+				apachelog.WithRequestIDHeader("X-Request-ID"),
+				apachelog.WithRequestIDResponseHeader("X-Request-ID"),
+			)
+			if !assert.NoError(t, err, "apachelog.New should succeed") {
+				return
+			}
+
+			var seen string
+			var buf bytes.Buffer
+			h := al.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = apachelog.RequestIDFromContext(r.Context())
+			}), &buf)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.incoming != "" {
+				r.Header.Set("X-Request-ID", tc.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			assert.Equal(t, tc.expected, seen, "handler should see the request ID")
+			assert.Equal(t, tc.expected, rec.Header().Get("X-Request-ID"), "request ID should be echoed")
+			if !assert.Equal(t, tc.expected+" "+tc.expected+"\n", buf.String(), "request ID should be logged") {
+				return
+			}
+
+			p, err := apachelog.NewParser(format)
+			if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+				return
+			}
+			parsed, err := p.Parse(buf.String())
+			if !assert.NoError(t, err, "Parse should succeed") {
+				return
+			}
+			assert.Equal(t, tc.expected, parsed.RequestID, "request ID should be parsed")
+		})
+	}
+
+	t.Run("Lazy generation", func(t *testing.T) {
+		var calls int
+		al, err := apachelog.New(`%h`, apachelog.WithRequestIDGenerator(apachelog.RequestIDGeneratorFunc(func() string {
+			calls++
+			return "generated"
+		})))
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+		al.Wrap(hello, ioutil.Discard).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, 0, calls, "IDs should not be generated when unused")
+	})
+
+	t.Run("Entry", func(t *testing.T) {
+		al, err := apachelog.New(format)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(apachelog.ContextWithRequestID(r.Context(), "replayed"))
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "replayed replayed\n", buf.String(), "request ID should be logged")
+	})
+}
+
+func TestTraceContext(t *testing.T) {
+	const format = `%{trace_id}x %{span_id}x %{parent_span_id}x %{sampled}x %{trace_flags}x %{tracestate}x`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	testcases := []struct {
+		name     string
+		header   http.Header
+		expected string
+	}{
+		{
+			name: "W3C Trace Context",
+			header: http.Header{
+				"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				"Tracestate":  {"congo=t61rcWkgMzE"},
+			},
+			expected: "4bf92f3577b34da6a3ce929d0e0e4736 00f067aa0ba902b7 - 1 01 congo=t61rcWkgMzE",
+		},
+		{
+			name:     "B3 single header",
+			header:   http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"}},
+			expected: "80f198ee56343ba864fe8b2a57d3eff7 e457b5a2e4d86bd1 05e3ac9a4f6e3b90 1 - -",
+		},
+		{
+			name: "B3 multiple headers",
+			header: http.Header{
+				"X-B3-Traceid": {"A3CE929D0E0E4736"},
+				"X-B3-Spanid":  {"00f067aa0ba902b7"},
+				"X-B3-Sampled": {"0"},
+			},
+			expected: "0000000000000000a3ce929d0e0e4736 00f067aa0ba902b7 - 0 - -",
+		},
+		{
+			name:     "Invalid traceparent",
+			header:   http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}},
+			expected: "- - - - - -",
+		},
+		{
+			name:     "No trace context",
+			header:   http.Header{},
+			expected: "- - - - - -",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header = tc.header
+
+			var buf bytes.Buffer
+			if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r)), "WriteLog should succeed") {
+				return
+			}
+			assert.Equal(t, tc.expected+"\n", buf.String(), "trace context should be logged")
+		})
+	}
+
+	t.Run("Child span", func(t *testing.T) {
+		al, err := apachelog.New(format, apachelog.WithChildSpan(true))
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+
+		var traceID, spanID string
+		var buf bytes.Buffer
+		h := al.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceID, spanID, _ = apachelog.TraceIDsFromContext(r.Context())
+		}), &buf)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		fields := strings.Fields(buf.String())
+		if !assert.Len(t, fields, 6, "all fields should be logged") {
+			return
+		}
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", fields[0], "trace ID should be kept")
+		assert.Regexp(t, `^[0-9a-f]{16}$`, fields[1], "a new span ID should be logged")
+		assert.NotEqual(t, "00f067aa0ba902b7", fields[1], "span ID should be new")
+		assert.Equal(t, "00f067aa0ba902b7", fields[2], "the incoming span should be the parent")
+		assert.Equal(t, fields[0], traceID, "handler should see the trace ID")
+		assert.Equal(t, fields[1], spanID, "handler should see the span ID")
+
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		fields = strings.Fields(buf.String())
+		if !assert.Len(t, fields, 6, "all fields should be logged") {
+			return
+		}
+		assert.Regexp(t, `^[0-9a-f]{32}$`, fields[0], "a new trace should be started")
+		assert.Regexp(t, `^[0-9a-f]{16}$`, fields[1], "a new span should be started")
+		assert.Equal(t, "-", fields[2], "a new trace has no parent")
+
+		p, err := apachelog.NewParser(format)
+		if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+			return
+		}
+		parsed, err := p.Parse(buf.String())
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		assert.Equal(t, fields[0], parsed.TraceID, "trace ID should be parsed")
+		assert.Equal(t, fields[1], parsed.SpanID, "span ID should be parsed")
+	})
+}
+
+func TestConnection(t *testing.T) {
+	const format = `%k %X`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(message))
+	})
+
+	out := &notifyWriter{lines: make(chan string, 4)}
+	s := httptest.NewUnstartedServer(al.Wrap(handler, out))
+	apachelog.NewConnTracker().Install(s.Config)
+	s.Start()
+	defer s.Close()
+
+	t.Run("Keep-alive", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if !assert.NoError(t, err, "Dial should succeed") {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		for i, expected := range []string{"0 +\n", "1 +\n", "2 -\n"} {
+			req := "GET / HTTP/1.1\r\nHost: example.com\r\n"
+			if i == 2 {
+				req += "Connection: close\r\n"
+			}
+			_, _ = conn.Write([]byte(req + "\r\n"))
+
+			res, err := http.ReadResponse(br, nil)
+			if !assert.NoError(t, err, "ReadResponse should succeed") {
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+
+			select {
+			case line := <-out.lines:
+				assert.Equal(t, expected, line, "log line should match")
+			case <-time.After(5 * time.Second):
+				t.Errorf("log line was not written")
+				return
+			}
+		}
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		inner, err := apachelog.New(format)
+		if !assert.NoError(t, err, "apachelog.New should succeed") {
+			return
+		}
+
+		innerOut := &notifyWriter{lines: make(chan string, 4)}
+		outerOut := &notifyWriter{lines: make(chan string, 4)}
+		s := httptest.NewUnstartedServer(al.Wrap(inner.Wrap(handler, innerOut), outerOut))
+		apachelog.NewConnTracker().Install(s.Config)
+		s.Start()
+		defer s.Close()
+
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if !assert.NoError(t, err, "Dial should succeed") {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		for _, expected := range []string{"0 +\n", "1 +\n"} {
+			_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+			res, err := http.ReadResponse(br, nil)
+			if !assert.NoError(t, err, "ReadResponse should succeed") {
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+
+			for _, out := range []*notifyWriter{innerOut, outerOut} {
+				select {
+				case line := <-out.lines:
+					assert.Equal(t, expected, line, "each request should only be counted once")
+				case <-time.After(5 * time.Second):
+					t.Errorf("log line was not written")
+					return
+				}
+			}
+		}
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if !assert.NoError(t, err, "Dial should succeed") {
+			return
+		}
+		_, _ = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+
+		select {
+		case line := <-out.lines:
+			assert.Equal(t, "0 X\n", line, "aborted request should be logged as such")
+		case <-time.After(5 * time.Second):
+			t.Errorf("log line was not written")
+		}
+	})
+
+	t.Run("Untracked", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "- -\n", buf.String(), "%k should be missing, and HTTP/1.0 should not be kept alive")
+
+		p, err := apachelog.NewParser(format)
+		if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+			return
+		}
+		parsed, err := p.Parse("3 +")
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		assert.Equal(t, int64(3), parsed.KeepAliveRequests, "%k should be parsed")
+		assert.Equal(t, "+", parsed.ConnectionStatus, "%X should be parsed")
+	})
+}
+
+func TestTLS(t *testing.T) {
+	const format = `%{SSL_PROTOCOL}x %{SSL_CIPHER}x %{SSL_TLS_SNI}x %{SSL_SESSION_RESUMED}x %{SSL_ALPN}x "%{SSL_CLIENT_S_DN}x" "%{SSL_CLIENT_I_DN}x"`
+	al, err := apachelog.New(format)
+	if !assert.NoError(t, err, "apachelog.New should succeed") {
+		return
+	}
+
+	out := &notifyWriter{lines: make(chan string, 1)}
+	s := httptest.NewTLSServer(al.Wrap(http.HandlerFunc(hello), out))
+	defer s.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				NextProtos:         []string{"http/1.1"},
+				ServerName:         "example.com",
+			},
+		},
+	}
+	res, err := client.Get(s.URL)
+	if !assert.NoError(t, err, "GET should succeed") {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	var line string
+	select {
+	case line = <-out.lines:
+	case <-time.After(5 * time.Second):
+		t.Errorf("log line was not written")
+		return
+	}
+	assert.Equal(t, "TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 example.com Initial http/1.1 \"-\" \"-\"\n", line, "TLS variables should be logged")
+
+	p, err := apachelog.NewParser(format)
+	if !assert.NoError(t, err, "apachelog.NewParser should succeed") {
+		return
+	}
+	parsed, err := p.Parse(strings.TrimSuffix(line, "\n"))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	assert.Equal(t, "TLSv1.2", parsed.SSL["SSL_PROTOCOL"], "SSL_PROTOCOL should be parsed")
+
+	t.Run("Client certificate", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{
+			Version:   tls.VersionTLS13,
+			DidResume: true,
+			PeerCertificates: []*x509.Certificate{{
+				Subject: pkix.Name{CommonName: "client", Organization: []string{"Acme"}},
+				Issuer:  pkix.Name{CommonName: "Acme CA"},
+			}},
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(r)), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "TLSv1.3 0x0000 - Resumed - \"CN=client,O=Acme\" \"CN=Acme CA\"\n", buf.String(), "client certificate should be logged")
+	})
+
+	t.Run("Plain HTTP", func(t *testing.T) {
+		var buf bytes.Buffer
+		if !assert.NoError(t, al.WriteLog(&buf, apachelog.NewEntry(httptest.NewRequest("GET", "/", nil))), "WriteLog should succeed") {
+			return
+		}
+		assert.Equal(t, "- - - - - \"-\" \"-\"\n", buf.String(), "TLS variables should be missing")
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	type clientIPCase struct {
+		Name       string
+		Options    []apachelog.Option
+		RemoteAddr string
+		Header     http.Header
+		Expected   string
+	}
+
+	cases := []clientIPCase{
+		{
+			Name:       "No trusted proxies",
+			RemoteAddr: "10.0.0.1:51111",
+			Header:     http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			Expected:   "10.0.0.1 10.0.0.1",
+		},
+		{
+			Name:       "IPv6 peer",
+			RemoteAddr: "[::1]:51111",
+			Expected:   "::1 ::1",
+		},
+		{
+			Name:       "Untrusted peer",
+			Options:    []apachelog.Option{apachelog.WithTrustedProxies("10.0.0.0/8")},
+			RemoteAddr: "172.16.0.1:51111",
+			Header:     http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			Expected:   "172.16.0.1 172.16.0.1",
+		},
+		{
+			Name:       "X-Forwarded-For through two proxies",
+			Options:    []apachelog.Option{apachelog.WithTrustedProxies("10.0.0.0/8")},
+			RemoteAddr: "10.0.0.1:51111",
+			Header:     http.Header{"X-Forwarded-For": {"203.0.113.9, 192.0.2.1", "10.1.1.1"}},
+			Expected:   "192.0.2.1 10.0.0.1",
+		},
+		{
+			Name: "X-Real-IP",
+			Options: []apachelog.Option{
+				apachelog.WithTrustedProxies("10.0.0.1"),
+				apachelog.WithRemoteIPHeader("X-Real-IP"),
+			},
+			RemoteAddr: "10.0.0.1:51111",
+			Header:     http.Header{"X-Real-Ip": {"192.0.2.1"}},
+			Expected:   "192.0.2.1 10.0.0.1",
+		},
+		{
+			Name: "Forwarded",
+			Options: []apachelog.Option{
+				apachelog.WithTrustedProxies("10.0.0.0/8", "2001:db8::/32"),
+				apachelog.WithRemoteIPHeader("Forwarded"),
+			},
+			RemoteAddr: "[2001:db8::1]:51111",
+			Header:     http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2`}},
+			Expected:   "2001:db8:cafe::17 2001:db8::1",
+		},
+		{
+			Name: "Forwarded with obfuscated identifier",
+			Options: []apachelog.Option{
+				apachelog.WithTrustedProxies("10.0.0.0/8"),
+				apachelog.WithRemoteIPHeader("Forwarded"),
+			},
+			RemoteAddr: "10.0.0.1:51111",
+			Header:     http.Header{"Forwarded": {`for=_hidden, for=10.0.0.2`}},
+			Expected:   "10.0.0.2 10.0.0.1",
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			al, err := apachelog.New(`%a %{c}a`, c.Options...)
+			if !assert.NoError(t, err, "apachelog.New should succeed") {
+				return
+			}
+
+			header := c.Header
+			if header == nil {
+				header = http.Header{}
+			}
+			ctx := &Context{
+				request: &http.Request{
+					RemoteAddr: c.RemoteAddr,
+					Header:     header,
+				},
+			}
+
+			var buf bytes.Buffer
+			if !assert.NoError(t, al.WriteLog(&buf, ctx), "WriteLog should succeed") {
+				return
+			}
+			assert.Equal(t, c.Expected+"\n", buf.String())
+		})
+	}
+
+	_, err := apachelog.New(`%a`, apachelog.WithTrustedProxies("not-an-address"))
+	assert.Error(t, err, "invalid trusted proxy should be rejected")
+}
@@ -0,0 +1,51 @@
+package apachelog
+
+import "github.com/lestrrat-go/apache-logformat/v2/internal/httputil"
+
+// transferCounter is implemented by LogCtx values that know the number
+// of bytes transferred for a request, including headers, like the
+// counters of mod_logio. The LogCtx used by ApacheLog.Wrap and Entry
+// implement it. When it is not implemented, or when it reports zero,
+// the numbers are estimated from the request and response headers
+type transferCounter interface {
+	BytesReceived() int64
+	BytesSent() int64
+}
+
+func bytesReceived(ctx LogCtx) int64 {
+	if tc, ok := ctx.(transferCounter); ok {
+		if n := tc.BytesReceived(); n > 0 {
+			return n
+		}
+	}
+
+	r := ctx.Request()
+	n := httputil.RequestHeaderSize(r)
+	if r.ContentLength > 0 {
+		n += r.ContentLength
+	}
+	return n
+}
+
+func bytesSent(ctx LogCtx) int64 {
+	if tc, ok := ctx.(transferCounter); ok {
+		if n := tc.BytesSent(); n > 0 {
+			return n
+		}
+	}
+
+	cl := ctx.ResponseContentLength()
+	return httputil.ResponseHeaderSize(ctx.Request(), ctx.ResponseStatus(), ctx.ResponseHeader(), cl) + cl
+}
+
+var requestBytesReceived = newField(func(ctx LogCtx) Value {
+	return IntValue(bytesReceived(ctx))
+})
+
+var responseBytesSent = newField(func(ctx LogCtx) Value {
+	return IntValue(bytesSent(ctx))
+})
+
+var bytesTransferred = newField(func(ctx LogCtx) Value {
+	return IntValue(bytesReceived(ctx) + bytesSent(ctx))
+})
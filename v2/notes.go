@@ -0,0 +1,72 @@
+package apachelog
+
+import (
+	"context"
+	"sync"
+)
+
+type notesKey struct{}
+
+// notes is a per-request store of notes, which handlers can use to
+// pass values to the log line. It lives in the request context, and
+// remains readable after the handler returns
+type notes struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// ContextWithNotes returns a copy of ctx that can store notes set via
+// SetNote. If ctx can already store notes, it is returned as is.
+// ApacheLog.Wrap does this for each request when its format logs notes
+// using %{...}n, so it is only needed when logging via WriteLog, e.g.
+// with an Entry
+func ContextWithNotes(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(notesKey{}).(*notes); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, notesKey{}, &notes{})
+}
+
+// SetNote attaches a note to the request whose context is ctx, which
+// can be logged using %{key}n, like notes set by Apache modules.
+// It is safe to call from multiple goroutines. Notes are silently
+// discarded if ctx can not store notes (see ContextWithNotes)
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//	  apachelog.SetNote(r.Context(), "user_id", "42")
+//	  ...
+//	}
+func SetNote(ctx context.Context, key, value string) {
+	n, ok := ctx.Value(notesKey{}).(*notes)
+	if !ok {
+		return
+	}
+
+	n.mu.Lock()
+	if n.values == nil {
+		n.values = make(map[string]string)
+	}
+	n.values[key] = value
+	n.mu.Unlock()
+}
+
+// GetNote returns the note that was set for key via SetNote
+func GetNote(ctx context.Context, key string) (string, bool) {
+	n, ok := ctx.Value(notesKey{}).(*notes)
+	if !ok {
+		return "", false
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	v, ok := n.values[key]
+	return v, ok
+}
+
+// requestNote is the value of a note set via SetNote
+type requestNote string
+
+func (n requestNote) Extract(ctx LogCtx) Value {
+	v, _ := GetNote(ctx.Request().Context(), string(n))
+	return stringOrMissing(v)
+}
@@ -0,0 +1,259 @@
+package apachelog
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option is used to pass optional parameters to New
+type Option interface {
+	Name() string
+	Value() interface{}
+}
+
+type option struct {
+	name  string
+	value interface{}
+}
+
+func (o *option) Name() string {
+	return o.name
+}
+
+func (o *option) Value() interface{} {
+	return o.value
+}
+
+const (
+	optkeyChildSpan               = "child-span"
+	optkeyClock                   = "clock"
+	optkeyCompress                = "compress"
+	optkeyErrorHandler            = "error-handler"
+	optkeyEscape                  = "escape"
+	optkeyLinkName                = "link-name"
+	optkeyLocation                = "location"
+	optkeyMaxAge                  = "max-age"
+	optkeyMaxSize                 = "max-size"
+	optkeyMissingValue            = "missing-value"
+	optkeyOverflowPolicy          = "overflow-policy"
+	optkeyQueueSize               = "queue-size"
+	optkeyRemoteIPHeader          = "remote-ip-header"
+	optkeyRequestIDGenerator      = "request-id-generator"
+	optkeyRequestIDHeader         = "request-id-header"
+	optkeyRequestIDResponseHeader = "request-id-response-header"
+	optkeyServerPort              = "server-port"
+	optkeyStrictCompile           = "strict-compile"
+	optkeyTrustedProxies          = "trusted-proxies"
+)
+
+// WithEscape specifies if values should be escaped before being
+// written. By default, double quotes and backslashes are escaped with
+// a backslash, and non-printable characters are written as \xhh, the
+// same way Apache does. This prevents clients from forging log lines
+// via request headers and the like.
+//
+// Only disable escaping if every value in the format is trusted.
+func WithEscape(v bool) Option {
+	return &option{
+		name:  optkeyEscape,
+		value: v,
+	}
+}
+
+// WithLocation specifies the time zone in which times such as %t are
+// written, e.g. time.UTC. By default the time zone of the Clock is used,
+// which is usually the local time zone
+func WithLocation(loc *time.Location) Option {
+	return &option{
+		name:  optkeyLocation,
+		value: loc,
+	}
+}
+
+// WithMissingValue specifies the string written in place of values
+// that are not available, such as request headers that were not sent.
+// The default is "-"
+func WithMissingValue(s string) Option {
+	return &option{
+		name:  optkeyMissingValue,
+		value: s,
+	}
+}
+
+// WithStrictCompile specifies if the format should be rejected when it
+// contains anything that is not understood, such as unknown directives.
+// By default unknown directives are ignored, and incomplete sequences
+// such as an unterminated "%{" are copied verbatim, and each of them is
+// reported by ApacheLog.Warnings. In strict mode the first such problem
+// is returned as a *CompileError
+func WithStrictCompile(v bool) Option {
+	return &option{
+		name:  optkeyStrictCompile,
+		value: v,
+	}
+}
+
+// WithErrorHandler specifies the function that is called when
+// ApacheLog.Wrap fails to write a log line. By default errors are
+// written to os.Stderr by a RateLimitedErrorHandler, at most once
+// per second
+func WithErrorHandler(h func(error, *http.Request)) Option {
+	return &option{
+		name:  optkeyErrorHandler,
+		value: h,
+	}
+}
+
+// WithTrustedProxies specifies the addresses of proxies (for example,
+// load balancers) that are trusted to report the client address
+// via the header specified by WithRemoteIPHeader. Each element may
+// either be a CIDR block such as "10.0.0.0/8", or a single IP address.
+//
+// When the peer address of a request is trusted, %a reports the
+// client address taken from the header, while %{c}a continues to
+// report the peer address. This mirrors the behavior of mod_remoteip
+func WithTrustedProxies(cidrs ...string) Option {
+	return &option{
+		name:  optkeyTrustedProxies,
+		value: cidrs,
+	}
+}
+
+// WithRemoteIPHeader specifies the name of the header from which
+// the client address is extracted when the request came through
+// a trusted proxy. "X-Forwarded-For" (the default), "X-Real-IP", and
+// the RFC 7239 "Forwarded" header are supported. Any other header
+// is treated as a comma separated list of addresses, similar to
+// X-Forwarded-For
+func WithRemoteIPHeader(name string) Option {
+	return &option{
+		name:  optkeyRemoteIPHeader,
+		value: name,
+	}
+}
+
+// WithChildSpan specifies if ApacheLog.Wrap should start a new span
+// for each request, as a child of the span in the W3C Trace Context or
+// B3 headers of the request. If the request has no trace context, a
+// new trace is started. %{span_id}x then logs the new span, and
+// %{parent_span_id}x the span of the caller. The span is only started
+// if the format logs one of the trace variants of %{...}x. The IDs are
+// then available to the handler via TraceIDsFromContext
+func WithChildSpan(v bool) Option {
+	return &option{
+		name:  optkeyChildSpan,
+		value: v,
+	}
+}
+
+// WithRequestIDGenerator specifies the generator used by ApacheLog.Wrap
+// to create request IDs, which are logged by %L and %{UNIQUE_ID}e. IDs
+// are only generated when they are used. The default is
+// NewUUIDv7Generator()
+func WithRequestIDGenerator(g RequestIDGenerator) Option {
+	return &option{
+		name:  optkeyRequestIDGenerator,
+		value: g,
+	}
+}
+
+// WithRequestIDHeader specifies the name of a request header, such as
+// "X-Request-ID", whose value is used as the request ID instead of
+// generating one. Values are trusted as is, so this should only be
+// used when every request passes through a proxy that sets the header.
+// Values that are empty, too long, or contain spaces or non-printable
+// characters are ignored
+func WithRequestIDHeader(name string) Option {
+	return &option{
+		name:  optkeyRequestIDHeader,
+		value: name,
+	}
+}
+
+// WithRequestIDResponseHeader specifies the name of a response header,
+// such as "X-Request-ID", which is set to the request ID before the
+// handler is called
+func WithRequestIDResponseHeader(name string) Option {
+	return &option{
+		name:  optkeyRequestIDResponseHeader,
+		value: name,
+	}
+}
+
+// WithServerPort specifies the canonical port of the server, which
+// is reported by %p and %{canonical}p. When unspecified, the port is
+// deduced from the Host header of each request
+func WithServerPort(port int) Option {
+	return &option{
+		name:  optkeyServerPort,
+		value: port,
+	}
+}
+
+// WithClock specifies the Clock used to obtain the current time.
+// When given to New, it is used to record the request and response
+// times in ApacheLog.Wrap. This is mostly useful for testing.
+func WithClock(c Clock) Option {
+	return &option{
+		name:  optkeyClock,
+		value: c,
+	}
+}
+
+// WithLinkName specifies the name of a symbolic link that always
+// points to the file that a RotatingWriter is currently writing to
+func WithLinkName(name string) Option {
+	return &option{
+		name:  optkeyLinkName,
+		value: name,
+	}
+}
+
+// WithMaxAge specifies how long a RotatingWriter keeps files around.
+// Files matching the file name pattern that have not been modified
+// for longer than d are removed when the writer rotates. By default
+// files are never removed.
+func WithMaxAge(d time.Duration) Option {
+	return &option{
+		name:  optkeyMaxAge,
+		value: d,
+	}
+}
+
+// WithMaxSize specifies the maximum size in bytes of each file
+// written by a RotatingWriter. When a write would exceed this size, a
+// new generation of the file is opened, with a numeric suffix such as
+// "access.log.1". By default there is no limit.
+func WithMaxSize(size int64) Option {
+	return &option{
+		name:  optkeyMaxSize,
+		value: size,
+	}
+}
+
+// WithCompress specifies if a RotatingWriter should gzip files once
+// it has rotated away from them
+func WithCompress(v bool) Option {
+	return &option{
+		name:  optkeyCompress,
+		value: v,
+	}
+}
+
+// WithQueueSize specifies the maximum number of lines that an
+// AsyncWriter holds before applying its OverflowPolicy
+func WithQueueSize(n int) Option {
+	return &option{
+		name:  optkeyQueueSize,
+		value: n,
+	}
+}
+
+// WithOverflowPolicy specifies what an AsyncWriter does when its
+// queue is full. The default is OverflowBlock
+func WithOverflowPolicy(p OverflowPolicy) Option {
+	return &option{
+		name:  optkeyOverflowPolicy,
+		value: p,
+	}
+}
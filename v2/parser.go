@@ -0,0 +1,418 @@
+package apachelog
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record is a log line parsed back into its components. Only the
+// fields whose directives appear in the format are populated.
+// Directives that were logged as "-" leave the corresponding field
+// at its zero value.
+type Record struct {
+	RemoteAddr            string            // %h
+	ClientAddr            string            // %a
+	PeerAddr              string            // %{c}a
+	Ident                 string            // %l
+	Username              string            // %u
+	RequestTime           time.Time         // %t, %{sec}t, %{msec}t, %{usec}t
+	RequestLine           string            // %r
+	Method                string            // %m, or derived from %r
+	URI                   string            // derived from %r
+	Protocol              string            // %H, or derived from %r
+	Path                  string            // %U
+	Query                 string            // %q, without the leading "?"
+	Host                  string            // %v, %V
+	RequestID             string            // %L, %{UNIQUE_ID}e
+	TraceID               string            // %{trace_id}x
+	SpanID                string            // %{span_id}x
+	ResponseStatus        int               // %>s, or %s and %<s if the format has no %>s
+	OriginalStatus        int               // %s, %<s
+	ResponseContentLength int64             // %b, %B
+	BytesReceived         int64             // %I
+	BytesSent             int64             // %O
+	BytesTransferred      int64             // %S
+	ElapsedTime           time.Duration     // %D, %T, %{unit}T
+	KeepAliveRequests     int64             // %k
+	ConnectionStatus      string            // %X
+	RequestHeader         http.Header       // %{Name}i
+	ResponseHeader        http.Header       // %{Name}o
+	RequestTrailer        http.Header       // %{Name}^ti
+	ResponseTrailer       http.Header       // %{Name}^to
+	Cookie                map[string]string // %{name}C
+	SetCookie             map[string]string // %{set:name}C
+	Notes                 map[string]string // %{name}n
+	SSL                   map[string]string // %{SSL_*}x, keyed by variable name
+	Environment           map[string]string
+
+	// Fields contains the raw text of every directive found in the
+	// line, keyed by the directive as written in the format, e.g.
+	// "%h" or "%{Referer}i"
+	Fields map[string]string
+}
+
+// Parser parses log lines that were generated by a given format.
+// It is the reverse of ApacheLog.WriteLog
+type Parser struct {
+	groups   []directive // directives for each capture group, in order
+	re       *regexp.Regexp
+	unescape bool
+}
+
+// NewParser creates a new Parser for lines that were written using
+// the given format. The format and options are the same as those
+// given to New. Values are unescaped unless WithEscape(false) is
+// specified
+func NewParser(format string, options ...Option) (*Parser, error) {
+	f, err := newFormat(format, options)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Parser{unescape: !f.noEscape}
+	var pattern strings.Builder
+	pattern.WriteByte('^')
+	for _, d := range f.directives {
+		if d.isLiteral() {
+			pattern.WriteString(regexp.QuoteMeta(d.String()))
+			continue
+		}
+		pattern.WriteByte('(')
+		pattern.WriteString(patternFor(d))
+		if d.status != "" {
+			// logged as "-" when the status condition does not match
+			pattern.WriteString("|-")
+		}
+		pattern.WriteByte(')')
+		p.groups = append(p.groups, d)
+	}
+	pattern.WriteByte('$')
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compile parser pattern")
+	}
+	p.re = re
+	return &p, nil
+}
+
+const (
+	// freeTextPattern matches arbitrary text, including quotes that
+	// were escaped with a backslash. It is non-greedy, so the literal
+	// text that follows the directive determines where it ends
+	freeTextPattern = `(?:[^"\\]|\\.)*?`
+	digitsPattern   = `\d+|-`
+	tokenPattern    = `\S*`
+)
+
+func patternFor(d directive) string {
+	switch d.verb {
+	case "b", "B", "D", "I", "k", "O", "p", "S":
+		return digitsPattern
+	case "s", "<s", ">s":
+		if d.key != "" {
+			return freeTextPattern
+		}
+		return `\d*`
+	case "a", "A", "h", "l", "L", "H", "P", "m", "q", "v", "V", "X":
+		return tokenPattern
+	case "t":
+		switch d.key {
+		case "":
+			return `\[[^\]]*\]`
+		case "sec", "msec", "usec":
+			return digitsPattern
+		}
+	case "T":
+		return digitsPattern
+	}
+	return freeTextPattern
+}
+
+// Parse parses a single log line. The trailing newline, if any, is
+// ignored
+func (p *Parser) Parse(line string) (*Record, error) {
+	line = strings.TrimSuffix(line, "\n")
+	m := p.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, errors.New("log line does not match format")
+	}
+
+	rec := Record{
+		Fields: make(map[string]string, len(p.groups)),
+	}
+	for i, d := range p.groups {
+		v := m[i+1]
+		if p.unescape {
+			var err error
+			if v, err = unescape(v); err != nil {
+				return nil, errors.Wrapf(err, "failed to unescape value for %s", d)
+			}
+		}
+		rec.Fields[d.String()] = v
+		if err := rec.assign(d, v); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse value for %s", d)
+		}
+	}
+	return &rec, nil
+}
+
+func (rec *Record) assign(d directive, v string) error {
+	if v == "-" {
+		return nil
+	}
+
+	switch d.verb {
+	case "h":
+		rec.RemoteAddr = v
+	case "a":
+		if d.key == "c" {
+			rec.PeerAddr = v
+		} else {
+			rec.ClientAddr = v
+		}
+	case "l":
+		rec.Ident = v
+	case "u":
+		rec.Username = v
+	case "t":
+		t, err := parseTime(d.key, v)
+		if err != nil {
+			return err
+		}
+		if !t.IsZero() {
+			rec.RequestTime = t
+		}
+	case "r":
+		rec.RequestLine = v
+		if i := strings.IndexByte(v, ' '); i > -1 {
+			rec.Method = v[:i]
+			v = v[i+1:]
+			if j := strings.LastIndexByte(v, ' '); j > -1 {
+				rec.URI = v[:j]
+				rec.Protocol = v[j+1:]
+			} else {
+				rec.URI = v
+			}
+		}
+	case "L":
+		rec.RequestID = v
+	case "x":
+		switch d.key {
+		case "trace_id":
+			rec.TraceID = v
+		case "span_id":
+			rec.SpanID = v
+		default:
+			if strings.HasPrefix(d.key, "SSL_") {
+				if rec.SSL == nil {
+					rec.SSL = make(map[string]string)
+				}
+				rec.SSL[d.key] = v
+			}
+		}
+	case "m":
+		rec.Method = v
+	case "H":
+		rec.Protocol = v
+	case "U":
+		rec.Path = v
+	case "q":
+		rec.Query = strings.TrimPrefix(v, "?")
+	case "v", "V":
+		rec.Host = v
+	case "s", "<s", ">s":
+		if v == "" || d.key != "" {
+			return nil
+		}
+		st, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if d.verb == ">s" {
+			rec.ResponseStatus = st
+			return nil
+		}
+		rec.OriginalStatus = st
+		if rec.ResponseStatus == 0 {
+			rec.ResponseStatus = st
+		}
+	case "k":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		rec.KeepAliveRequests = n
+	case "X":
+		rec.ConnectionStatus = v
+	case "b", "B", "I", "O", "S":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		switch d.verb {
+		case "I":
+			rec.BytesReceived = n
+		case "O":
+			rec.BytesSent = n
+		case "S":
+			rec.BytesTransferred = n
+		default:
+			rec.ResponseContentLength = n
+		}
+	case "D", "T":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		unit := time.Microsecond
+		if d.verb == "T" {
+			switch d.key {
+			case "", "s":
+				unit = time.Second
+			case "ms":
+				unit = time.Millisecond
+			}
+		}
+		rec.ElapsedTime = time.Duration(n) * unit
+	case "i":
+		if rec.RequestHeader == nil {
+			rec.RequestHeader = http.Header{}
+		}
+		rec.RequestHeader.Add(d.key, v)
+	case "o":
+		if rec.ResponseHeader == nil {
+			rec.ResponseHeader = http.Header{}
+		}
+		rec.ResponseHeader.Add(d.key, v)
+	case "C":
+		if strings.HasPrefix(d.key, setCookiePrefix) {
+			if rec.SetCookie == nil {
+				rec.SetCookie = make(map[string]string)
+			}
+			rec.SetCookie[strings.TrimPrefix(d.key, setCookiePrefix)] = v
+			return nil
+		}
+		if rec.Cookie == nil {
+			rec.Cookie = make(map[string]string)
+		}
+		rec.Cookie[d.key] = v
+	case "n":
+		if rec.Notes == nil {
+			rec.Notes = make(map[string]string)
+		}
+		rec.Notes[d.key] = v
+	case "^ti":
+		if rec.RequestTrailer == nil {
+			rec.RequestTrailer = http.Header{}
+		}
+		rec.RequestTrailer.Add(d.key, v)
+	case "^to":
+		if rec.ResponseTrailer == nil {
+			rec.ResponseTrailer = http.Header{}
+		}
+		rec.ResponseTrailer.Add(d.key, v)
+	case "e":
+		if rec.Environment == nil {
+			rec.Environment = make(map[string]string)
+		}
+		rec.Environment[d.key] = v
+		if d.key == "UNIQUE_ID" {
+			rec.RequestID = v
+		}
+	}
+	return nil
+}
+
+// parseTime parses the value of a %t or %{format}t directive. Formats
+// that can not be reversed yield the zero time
+func parseTime(key, v string) (time.Time, error) {
+	var unit time.Duration
+	switch key {
+	case "":
+		return time.Parse(clfTimeLayout, v)
+	case "sec":
+		unit = time.Second
+	case "msec":
+		unit = time.Millisecond
+	case "usec":
+		unit = time.Microsecond
+	default:
+		return time.Time{}, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n*int64(unit)), nil
+}
+
+// Scanner reads log lines from an io.Reader and parses them using
+// a Parser. Its usage mirrors that of bufio.Scanner:
+//
+//	s := p.NewScanner(f)
+//	for s.Scan() {
+//	  rec := s.Record()
+//	  ...
+//	}
+//	if err := s.Err(); err != nil {
+//	  ...
+//	}
+type Scanner struct {
+	err     error
+	line    int
+	parser  *Parser
+	record  *Record
+	scanner *bufio.Scanner
+}
+
+// NewScanner creates a new Scanner that reads lines from src.
+func (p *Parser) NewScanner(src io.Reader) *Scanner {
+	return &Scanner{
+		parser:  p,
+		scanner: bufio.NewScanner(src),
+	}
+}
+
+// Scan advances to the next line. It returns false when there are no
+// more lines, or when a line fails to be read or parsed. In the latter
+// case Err returns the cause
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	if !s.scanner.Scan() {
+		s.err = s.scanner.Err()
+		s.record = nil
+		return false
+	}
+	s.line++
+
+	rec, err := s.parser.Parse(s.scanner.Text())
+	if err != nil {
+		s.err = errors.Wrapf(err, "failed to parse line %d", s.line)
+		s.record = nil
+		return false
+	}
+	s.record = rec
+	return true
+}
+
+// Record returns the most recently parsed Record
+func (s *Scanner) Record() *Record {
+	return s.record
+}
+
+// Err returns the first error encountered by the Scanner
+func (s *Scanner) Err() error {
+	return s.err
+}
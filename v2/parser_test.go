@@ -0,0 +1,101 @@
+package apachelog_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	apachelog "github.com/lestrrat-go/apache-logformat/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const combinedFormat = `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`
+
+func TestParserRoundTrip(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://golang.org/foo/bar?baz=1", nil)
+	if !assert.NoError(t, err, "request creation should succeed") {
+		return
+	}
+	r.RemoteAddr = "192.168.0.1:51111"
+	r.Header.Set("Referer", "http://dummy.com")
+	r.Header.Set("User-Agent", "Apache-LogFormat Port In Golang")
+
+	requestTime := time.Date(2020, time.September, 29, 12, 34, 56, 0, time.UTC)
+	ctx := &Context{
+		request:               r,
+		requestTime:           requestTime,
+		responseContentLength: 1234,
+		responseStatus:        http.StatusNotFound,
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, apachelog.CombinedLog.WriteLog(&buf, ctx), "WriteLog should succeed") {
+		return
+	}
+
+	p, err := apachelog.NewParser(combinedFormat)
+	if !assert.NoError(t, err, "NewParser should succeed") {
+		return
+	}
+
+	rec, err := p.Parse(buf.String())
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	assert.Equal(t, "192.168.0.1", rec.RemoteAddr)
+	assert.Equal(t, "", rec.Username)
+	assert.True(t, requestTime.Equal(rec.RequestTime), "request time should match")
+	assert.Equal(t, "GET", rec.Method)
+	assert.Equal(t, "http://golang.org/foo/bar?baz=1", rec.URI)
+	assert.Equal(t, "HTTP/1.1", rec.Protocol)
+	assert.Equal(t, http.StatusNotFound, rec.ResponseStatus)
+	assert.Equal(t, int64(1234), rec.ResponseContentLength)
+	assert.Equal(t, "http://dummy.com", rec.RequestHeader.Get("Referer"))
+	assert.Equal(t, "Apache-LogFormat Port In Golang", rec.RequestHeader.Get("User-Agent"))
+	assert.Equal(t, "-", rec.Fields["%u"])
+}
+
+func TestParserMismatch(t *testing.T) {
+	p, err := apachelog.NewParser(`%h "%r" %>s`)
+	if !assert.NoError(t, err, "NewParser should succeed") {
+		return
+	}
+
+	_, err = p.Parse(`127.0.0.1 GET / HTTP/1.1 200`)
+	assert.Error(t, err, "Parse should fail for lines that do not match")
+}
+
+func TestScanner(t *testing.T) {
+	p, err := apachelog.NewParser(`%h %>s %b %D`)
+	if !assert.NoError(t, err, "NewParser should succeed") {
+		return
+	}
+
+	src := strings.NewReader("127.0.0.1 200 13 1500\n10.0.0.1 304 - 20\n")
+	s := p.NewScanner(src)
+
+	var records []*apachelog.Record
+	for s.Scan() {
+		records = append(records, s.Record())
+	}
+	if !assert.NoError(t, s.Err(), "Scanner should not fail") {
+		return
+	}
+	if !assert.Len(t, records, 2, "expected two records") {
+		return
+	}
+
+	assert.Equal(t, "127.0.0.1", records[0].RemoteAddr)
+	assert.Equal(t, int64(13), records[0].ResponseContentLength)
+	assert.Equal(t, 1500*time.Microsecond, records[0].ElapsedTime)
+	assert.Equal(t, http.StatusNotModified, records[1].ResponseStatus)
+	assert.Equal(t, int64(0), records[1].ResponseContentLength)
+
+	s = p.NewScanner(strings.NewReader("127.0.0.1 200 13 1500\nbogus\n"))
+	assert.True(t, s.Scan(), "first line should parse")
+	assert.False(t, s.Scan(), "second line should fail")
+	assert.EqualError(t, s.Err(), "failed to parse line 2: log line does not match format")
+}
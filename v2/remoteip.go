@@ -0,0 +1,161 @@
+package apachelog
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+)
+
+// remoteIPResolver determines the address of the client that
+// originated a request, looking through any trusted proxies in the way.
+type remoteIPResolver struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newRemoteIPResolver(header string, cidrs []string) (*remoteIPResolver, error) {
+	if header == "" {
+		header = headerXForwardedFor
+	}
+
+	r := remoteIPResolver{
+		header: textproto.CanonicalMIMEHeaderKey(header),
+	}
+	for _, cidr := range cidrs {
+		if !strings.ContainsRune(cidr, '/') {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+				bits = 8 * net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy address %q", cidr)
+		}
+		r.trusted = append(r.trusted, ipnet)
+	}
+	return &r, nil
+}
+
+func (r *remoteIPResolver) isTrusted(ip net.IP) bool {
+	for _, ipnet := range r.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. If the peer is a
+// trusted proxy, the addresses listed in the configured header are
+// examined from right to left, and the first address that does not
+// belong to a trusted proxy is returned.
+func (r *remoteIPResolver) ClientIP(req *http.Request) string {
+	peer := peerIP(req)
+	if r == nil || len(r.trusted) == 0 {
+		return peer
+	}
+
+	ip := net.ParseIP(peer)
+	if ip == nil || !r.isTrusted(ip) {
+		return peer
+	}
+
+	addrs := r.forwardedAddrs(req.Header)
+	client := peer
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			// Obfuscated or otherwise invalid address. We can not see
+			// past this point, so the last valid address is the client
+			break
+		}
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedAddrs returns the list of addresses recorded by proxies,
+// with the address closest to the client first
+func (r *remoteIPResolver) forwardedAddrs(h http.Header) []string {
+	var addrs []string
+	switch {
+	case strings.EqualFold(r.header, headerXRealIP):
+		if v := strings.TrimSpace(h.Get(headerXRealIP)); v != "" {
+			addrs = append(addrs, stripPort(v))
+		}
+	case strings.EqualFold(r.header, headerForwarded):
+		for _, v := range h[headerForwarded] {
+			addrs = append(addrs, parseForwarded(v)...)
+		}
+	default:
+		for _, v := range h[r.header] {
+			for _, addr := range strings.Split(v, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					addrs = append(addrs, stripPort(addr))
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// parseForwarded extracts the "for" parameters from an RFC 7239
+// Forwarded header value
+func parseForwarded(v string) []string {
+	var addrs []string
+	for _, elem := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			pair = strings.TrimSpace(pair)
+			i := strings.IndexByte(pair, '=')
+			if i < 0 || !strings.EqualFold(pair[:i], "for") {
+				continue
+			}
+			addrs = append(addrs, stripPort(strings.Trim(pair[i+1:], `"`)))
+		}
+	}
+	return addrs
+}
+
+// stripPort removes the port and IPv6 brackets from an address, if any
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// peerIP returns the address of the immediate peer of the request
+func peerIP(r *http.Request) string {
+	return stripPort(r.RemoteAddr)
+}
+
+func makeClientIP(resolver *remoteIPResolver) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		return stringOrMissing(resolver.ClientIP(ctx.Request()))
+	})
+}
+
+var peerIPAddr = newField(func(ctx LogCtx) Value {
+	return stringOrMissing(peerIP(ctx.Request()))
+})
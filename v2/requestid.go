@@ -0,0 +1,168 @@
+package apachelog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDGenerator generates unique IDs for requests
+type RequestIDGenerator interface {
+	NewRequestID() string
+}
+
+// RequestIDGeneratorFunc is a function that implements RequestIDGenerator
+type RequestIDGeneratorFunc func() string
+
+func (f RequestIDGeneratorFunc) NewRequestID() string {
+	return f()
+}
+
+// NewUUIDv7Generator creates a RequestIDGenerator that generates
+// version 7 UUIDs (RFC 9562), such as
+// "01890a5d-ac96-774b-bcce-b302099a8057". This is the default
+func NewUUIDv7Generator() RequestIDGenerator {
+	return RequestIDGeneratorFunc(func() string {
+		var b [16]byte
+		putTimeAndRandom(b[:], time.Now())
+		b[6] = (b[6] & 0x0f) | 0x70 // version 7
+		b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+		var s [36]byte
+		hex.Encode(s[0:8], b[0:4])
+		s[8] = '-'
+		hex.Encode(s[9:13], b[4:6])
+		s[13] = '-'
+		hex.Encode(s[14:18], b[6:8])
+		s[18] = '-'
+		hex.Encode(s[19:23], b[8:10])
+		s[23] = '-'
+		hex.Encode(s[24:], b[10:])
+		return string(s[:])
+	})
+}
+
+// crockford is the alphabet of Crockford's base32, used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULIDGenerator creates a RequestIDGenerator that generates ULIDs
+// (https://github.com/ulid/spec), such as "01H4556BMVEXCEYT6J3CTVMC4Q"
+func NewULIDGenerator() RequestIDGenerator {
+	return RequestIDGeneratorFunc(func() string {
+		var b [16]byte
+		putTimeAndRandom(b[:], time.Now())
+
+		// 128 bits are encoded in 26 characters of 5 bits each, with
+		// 2 bits of leading zero padding
+		var s [26]byte
+		for i := range s {
+			var v byte
+			for j := 0; j < 5; j++ {
+				v <<= 1
+				if bit := i*5 + j - 2; bit >= 0 && b[bit/8]&(0x80>>uint(bit%8)) != 0 {
+					v |= 1
+				}
+			}
+			s[i] = crockford[v]
+		}
+		return string(s[:])
+	})
+}
+
+// uniqueIDEncoding is the variant of base64 used by mod_unique_id,
+// which is safe to use in URLs and file names
+var uniqueIDEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789@-").WithPadding(base64.NoPadding)
+
+// NewUniqueIDGenerator creates a RequestIDGenerator that generates IDs
+// in the format of Apache's mod_unique_id (version 2.4), such as
+// "atLDvzf2vhcZ1Fcy6qgAAAAAAAA". Each ID encodes the time in seconds,
+// 10 random bytes chosen when the generator is created, and a counter.
+// mod_unique_id splits the counter into a 16-bit counter and a 32-bit
+// thread index; here they form a single 48-bit counter
+func NewUniqueIDGenerator() RequestIDGenerator {
+	var root [10]byte
+	_, _ = rand.Read(root[:])
+	var counter uint64
+	return RequestIDGeneratorFunc(func() string {
+		n := atomic.AddUint64(&counter, 1) - 1
+
+		var b [20]byte
+		binary.BigEndian.PutUint32(b[0:4], uint32(time.Now().Unix()))
+		copy(b[4:14], root[:])
+		binary.BigEndian.PutUint16(b[14:16], uint16(n))
+		binary.BigEndian.PutUint32(b[16:20], uint32(n>>16))
+		return uniqueIDEncoding.EncodeToString(b[:])
+	})
+}
+
+// putTimeAndRandom writes the unix time of t in milliseconds to the
+// first 6 bytes of b, and fills the rest with random bytes
+func putTimeAndRandom(b []byte, t time.Time) {
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b[:6], ms[2:])
+	_, _ = rand.Read(b[6:])
+}
+
+type requestIDKey struct{}
+
+// requestID is the ID of a request, which is generated the first time
+// that it is needed
+type requestID struct {
+	once      sync.Once
+	generator RequestIDGenerator
+	id        string
+}
+
+func (rid *requestID) get() string {
+	rid.once.Do(func() {
+		if rid.id == "" && rid.generator != nil {
+			rid.id = rid.generator.NewRequestID()
+		}
+	})
+	return rid.id
+}
+
+// ContextWithRequestID returns a copy of ctx that carries id as the
+// request ID. ApacheLog.Wrap does this for each request when its format
+// logs the request ID, or when WithRequestIDResponseHeader is used, so
+// it is only needed when logging via WriteLog, e.g. with an Entry
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, &requestID{id: id})
+}
+
+// RequestIDFromContext returns the ID of the request whose context is
+// ctx, as logged by %L and %{UNIQUE_ID}e. If the ID has not been used
+// yet, it is generated
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	rid, ok := ctx.Value(requestIDKey{}).(*requestID)
+	if !ok {
+		return "", false
+	}
+	id := rid.get()
+	return id, id != ""
+}
+
+// validRequestID checks that an incoming request ID is short, and only
+// contains printable ASCII characters other than space
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 200 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+var requestIDField = newField(func(ctx LogCtx) Value {
+	id, _ := RequestIDFromContext(ctx.Request().Context())
+	return stringOrMissing(id)
+})
@@ -0,0 +1,401 @@
+package apachelog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	strftime "github.com/lestrrat-go/strftime"
+	"github.com/pkg/errors"
+)
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// RotatingWriter is an io.WriteCloser that writes to a file whose
+// name is generated from a strftime(3) pattern. A new file is opened
+// whenever the generated name changes, or when the current file would
+// exceed the maximum size. It is safe to use from multiple goroutines,
+// so it can be passed directly to ApacheLog.Wrap
+//
+//	w, err := apachelog.NewRotatingWriter(
+//	  "/var/log/app/access.%Y%m%d%H.log",
+//	  apachelog.WithLinkName("/var/log/app/access.log"),
+//	  apachelog.WithMaxAge(7*24*time.Hour),
+//	)
+type RotatingWriter struct {
+	clock    Clock
+	compress bool
+	glob     string
+	linkName string
+	names    *regexp.Regexp
+	maxAge   time.Duration
+	maxSize  int64
+	pattern  *strftime.Strftime
+
+	mu         sync.Mutex
+	background sync.WaitGroup
+	closed     bool
+	file       *os.File
+	basename   string // name generated from the pattern
+	filename   string // name of the file currently open
+	generation int
+	size       int64
+}
+
+// NewRotatingWriter creates a new RotatingWriter. pattern is a
+// strftime(3) pattern used to generate file names, such as
+// "access.%Y%m%d%H.log". The file is not opened until the first write.
+//
+// WithClock, WithLinkName, WithMaxAge, WithMaxSize, and WithCompress
+// may be used to configure the writer.
+func NewRotatingWriter(pattern string, options ...Option) (*RotatingWriter, error) {
+	p, err := strftime.New(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compile file name pattern")
+	}
+
+	w := RotatingWriter{
+		clock:   systemClock{},
+		glob:    globFromPattern(pattern),
+		names:   regexpFromPattern(pattern),
+		pattern: p,
+	}
+	for _, o := range options {
+		switch o.Name() {
+		case optkeyClock:
+			w.clock = o.Value().(Clock)
+		case optkeyCompress:
+			w.compress = o.Value().(bool)
+		case optkeyLinkName:
+			w.linkName = o.Value().(string)
+		case optkeyMaxAge:
+			w.maxAge = o.Value().(time.Duration)
+		case optkeyMaxSize:
+			w.maxSize = o.Value().(int64)
+		}
+	}
+	return &w, nil
+}
+
+var strftimeVerb = regexp.MustCompile(`%[A-Za-z]`)
+
+// globFromPattern converts a strftime pattern into a glob that
+// matches every file that it may generate, including rotated
+// generations and compressed files. The glob may match other files
+// too, so the matches must be checked using regexpFromPattern
+func globFromPattern(pattern string) string {
+	return strftimeVerb.ReplaceAllString(pattern, "*") + "*"
+}
+
+// strftimeVerbPatterns are the regular expressions matching the text
+// generated by each strftime verb
+var strftimeVerbPatterns = map[byte]string{
+	'A': `[A-Za-z]+`,
+	'a': `[A-Za-z]+`,
+	'B': `[A-Za-z]+`,
+	'b': `[A-Za-z]+`,
+	'C': `\d{2}`,
+	'D': `\d{2}/\d{2}/\d{2}`,
+	'd': `\d{2}`,
+	'e': `[ \d]\d`,
+	'F': `\d{4}-\d{2}-\d{2}`,
+	'H': `\d{2}`,
+	'h': `[A-Za-z]+`,
+	'I': `\d{2}`,
+	'j': `\d{3}`,
+	'k': `[ \d]\d`,
+	'l': `[ \d]\d`,
+	'M': `\d{2}`,
+	'm': `\d{2}`,
+	'n': `\n`,
+	'p': `[AP]M`,
+	'R': `\d{2}:\d{2}`,
+	'S': `\d{2}`,
+	'T': `\d{2}:\d{2}:\d{2}`,
+	't': `\t`,
+	'U': `\d{2}`,
+	'u': `\d`,
+	'V': `\d{2}`,
+	'W': `\d{2}`,
+	'w': `\d`,
+	'Y': `\d{4}`,
+	'y': `\d{2}`,
+	'z': `[-+]\d{4}`,
+	'%': `%`,
+}
+
+// regexpFromPattern converts a strftime pattern into a regular
+// expression that only matches the files that it may generate,
+// including rotated generations and compressed files. Paths must be
+// cleaned using filepath.Clean before they are matched
+func regexpFromPattern(pattern string) *regexp.Regexp {
+	pattern = filepath.Clean(pattern)
+
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			continue
+		}
+		i++
+		if re, ok := strftimeVerbPatterns[pattern[i]]; ok {
+			b.WriteString(re)
+		} else {
+			// Locale dependent representations, and time zone names
+			b.WriteString(`[^/]+`)
+		}
+	}
+	b.WriteString(`(\.\d+)?(\.gz)?$`)
+	return regexp.MustCompile(b.String())
+}
+
+// Write writes p to the current file, rotating it first if necessary.
+// It returns os.ErrClosed once the writer has been closed.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	if err := w.rotateIfNeeded(int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, errors.Wrap(err, "failed to write to log file")
+	}
+	return n, nil
+}
+
+// Rotate forces the writer to switch to a new file. If the name
+// generated from the pattern has not changed, a new generation of the
+// same file is opened. It returns os.ErrClosed once the writer has
+// been closed.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	basename := w.pattern.FormatString(w.clock.Now())
+	if basename == w.basename {
+		return w.open(basename, w.generation+1)
+	}
+	return w.open(basename, 0)
+}
+
+// Close closes the current file, and waits for any pending compression
+// or cleanup of rotated files to finish. The writer can not be used
+// afterwards.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+
+	w.background.Wait()
+	if err != nil {
+		return errors.Wrap(err, "failed to close log file")
+	}
+	return nil
+}
+
+// CurrentFileName returns the name of the file currently being
+// written to. It returns an empty string if no file has been opened yet
+func (w *RotatingWriter) CurrentFileName() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.filename
+}
+
+func (w *RotatingWriter) rotateIfNeeded(incoming int64) error {
+	basename := w.pattern.FormatString(w.clock.Now())
+	if w.file == nil || basename != w.basename {
+		return w.open(basename, 0)
+	}
+
+	if w.maxSize > 0 && w.size > 0 && w.size+incoming > w.maxSize {
+		return w.open(basename, w.generation+1)
+	}
+	return nil
+}
+
+func generationName(basename string, generation int) string {
+	if generation == 0 {
+		return basename
+	}
+	return basename + "." + strconv.Itoa(generation)
+}
+
+// open switches to the given generation of basename. If that file
+// already exists and is full, later generations are tried
+func (w *RotatingWriter) open(basename string, generation int) error {
+	var filename string
+	var size int64
+	for {
+		filename = generationName(basename, generation)
+		if w.compress {
+			// Generations that were already compressed must not be
+			// reused, as their archive would be overwritten
+			if _, err := os.Stat(filename + ".gz"); err == nil {
+				generation++
+				continue
+			}
+		}
+		fi, err := os.Stat(filename)
+		if err != nil || w.maxSize <= 0 || fi.Size() < w.maxSize {
+			if err == nil {
+				size = fi.Size()
+			}
+			break
+		}
+		generation++
+	}
+
+	if dir := filepath.Dir(filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "failed to create log directory")
+		}
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open log file")
+	}
+
+	prev, prevName := w.file, w.filename
+	w.file = f
+	w.basename = basename
+	w.filename = filename
+	w.generation = generation
+	w.size = size
+
+	// The new file is in use from now on, so the previous one is
+	// closed even if the symlink can not be updated
+	var linkErr error
+	if w.linkName != "" {
+		linkErr = replaceSymlink(filename, w.linkName)
+	}
+
+	if prev != nil {
+		if err := prev.Close(); err != nil {
+			return errors.Wrap(err, "failed to close previous log file")
+		}
+	}
+
+	if (prevName != "" && prevName != filename && w.compress) || w.maxAge > 0 {
+		w.background.Add(1)
+		go w.cleanup(prevName, filename)
+	}
+	return linkErr
+}
+
+// replaceSymlink atomically points linkName to filename
+func replaceSymlink(filename, linkName string) error {
+	target := filename
+	if abs, err := filepath.Abs(filename); err == nil {
+		target = abs
+	}
+
+	tmp := linkName + ".tmp" + strconv.Itoa(os.Getpid())
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return errors.Wrap(err, "failed to create symlink")
+	}
+	if err := os.Rename(tmp, linkName); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrap(err, "failed to replace symlink")
+	}
+	return nil
+}
+
+// cleanup compresses the previous file, if requested, and removes
+// files that are older than the maximum age.
+func (w *RotatingWriter) cleanup(prev, current string) {
+	defer w.background.Done()
+
+	if w.compress && prev != "" && prev != current {
+		_ = compressFile(prev)
+	}
+
+	if w.maxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(w.glob)
+	if err != nil {
+		return
+	}
+
+	cutoff := w.clock.Now().Add(-1 * w.maxAge)
+	for _, path := range matches {
+		if path == current || path == w.linkName || !w.names.MatchString(filepath.Clean(path)) {
+			continue
+		}
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if fi.ModTime().Before(cutoff) {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+// compressFile gzips filename into filename.gz, and removes the
+// original. An existing filename.gz is never overwritten: the original
+// is kept instead
+func compressFile(filename string) error {
+	if err := gzipFile(filename, filename+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+func gzipFile(srcName, dstName string) error {
+	src, err := os.Open(srcName)
+	if err != nil {
+		return errors.Wrap(err, "failed to open rotated file")
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create compressed file")
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dstName)
+		return errors.Wrap(err, "failed to compress rotated file")
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package apachelog_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	apachelog "github.com/lestrrat-go/apache-logformat/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func listFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if !assert.NoError(t, err, "ReadDir should succeed") {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingWriterTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cl := clock.NewMock()
+	cl.Add(time.Date(2020, time.September, 29, 12, 0, 0, 0, time.UTC).Sub(cl.Now()))
+
+	linkName := filepath.Join(dir, "access.log")
+	w, err := apachelog.NewRotatingWriter(
+		filepath.Join(dir, "access.%Y%m%d%H.log"),
+		apachelog.WithClock(cl),
+		apachelog.WithLinkName(linkName),
+	)
+	if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+		return
+	}
+
+	_, _ = w.Write([]byte("first\n"))
+	cl.Add(time.Hour)
+	_, _ = w.Write([]byte("second\n"))
+	if !assert.NoError(t, w.Close(), "Close should succeed") {
+		return
+	}
+
+	assert.Equal(t, []string{"access.2020092912.log", "access.2020092913.log", "access.log"}, listFiles(t, dir))
+
+	content, err := ioutil.ReadFile(linkName)
+	if !assert.NoError(t, err, "reading through the symlink should succeed") {
+		return
+	}
+	assert.Equal(t, "second\n", string(content))
+}
+
+func TestRotatingWriterClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := apachelog.NewRotatingWriter(filepath.Join(dir, "access.log"))
+	if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+		return
+	}
+	_, _ = w.Write([]byte("first\n"))
+	if !assert.NoError(t, w.Close(), "Close should succeed") {
+		return
+	}
+
+	_, err = w.Write([]byte("second\n"))
+	assert.Equal(t, os.ErrClosed, err, "Write should fail after Close")
+	assert.Equal(t, os.ErrClosed, w.Rotate(), "Rotate should fail after Close")
+	assert.NoError(t, w.Close(), "Close should be idempotent")
+
+	assert.Equal(t, []string{"access.log"}, listFiles(t, dir), "no file should be opened after Close")
+	content, err := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	if !assert.NoError(t, err, "ReadFile should succeed") {
+		return
+	}
+	assert.Equal(t, "first\n", string(content), "nothing should be written after Close")
+}
+
+func TestRotatingWriterSizeAndCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := apachelog.NewRotatingWriter(
+		filepath.Join(dir, "access.log"),
+		apachelog.WithMaxSize(10),
+		apachelog.WithCompress(true),
+	)
+	if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = w.Write([]byte("12345678\n"))
+		}()
+	}
+	wg.Wait()
+	if !assert.NoError(t, w.Close(), "Close should succeed") {
+		return
+	}
+
+	assert.Equal(t, []string{"access.log.1.gz", "access.log.2", "access.log.gz"}, listFiles(t, dir))
+
+	f, err := os.Open(filepath.Join(dir, "access.log.gz"))
+	if !assert.NoError(t, err, "opening compressed file should succeed") {
+		return
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if !assert.NoError(t, err, "gzip.NewReader should succeed") {
+		return
+	}
+	content, err := ioutil.ReadAll(gz)
+	if !assert.NoError(t, err, "reading compressed file should succeed") {
+		return
+	}
+	assert.Equal(t, "12345678\n", string(content))
+}
+
+func readGzip(t *testing.T, filename string) string {
+	f, err := os.Open(filename)
+	if !assert.NoError(t, err, "opening compressed file should succeed") {
+		return ""
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if !assert.NoError(t, err, "gzip.NewReader should succeed") {
+		return ""
+	}
+	content, err := ioutil.ReadAll(gz)
+	if !assert.NoError(t, err, "reading compressed file should succeed") {
+		return ""
+	}
+	return string(content)
+}
+
+func TestRotatingWriterCompressRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, run := range []string{"run0", "run1"} {
+		w, err := apachelog.NewRotatingWriter(
+			filepath.Join(dir, "access.log"),
+			apachelog.WithMaxSize(10),
+			apachelog.WithCompress(true),
+		)
+		if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+			return
+		}
+		_, _ = w.Write([]byte(run + "-a\n"))
+		_, _ = w.Write([]byte(run + "-b\n"))
+		if !assert.NoError(t, w.Close(), "Close should succeed") {
+			return
+		}
+	}
+
+	assert.Equal(t, []string{"access.log.1.gz", "access.log.2", "access.log.gz"}, listFiles(t, dir))
+	assert.Equal(t, "run0-a\n", readGzip(t, filepath.Join(dir, "access.log.gz")), "first archive should not be overwritten")
+	assert.Equal(t, "run0-b\nrun1-a\n", readGzip(t, filepath.Join(dir, "access.log.1.gz")), "restart should append to the last generation")
+}
+
+func TestRotatingWriterMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "access.2000010100.log")
+	if !assert.NoError(t, ioutil.WriteFile(old, []byte("old\n"), 0644), "WriteFile should succeed") {
+		return
+	}
+	longAgo := time.Now().Add(-48 * time.Hour)
+	if !assert.NoError(t, os.Chtimes(old, longAgo, longAgo), "Chtimes should succeed") {
+		return
+	}
+
+	w, err := apachelog.NewRotatingWriter(
+		filepath.Join(dir, "access.%Y%m%d%H.log"),
+		apachelog.WithMaxAge(24*time.Hour),
+	)
+	if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+		return
+	}
+	_, _ = w.Write([]byte("new\n"))
+	if !assert.NoError(t, w.Close(), "Close should succeed") {
+		return
+	}
+
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err), "old file should have been removed")
+	assert.Len(t, listFiles(t, dir), 1, "only the current file should remain")
+}
+
+func TestRotatingWriterMaxAgeUnrelatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apachelog-rotate")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"20000101", "20000101.1.gz", "notes.txt", "2000"} {
+		filename := filepath.Join(dir, name)
+		if !assert.NoError(t, ioutil.WriteFile(filename, []byte("old\n"), 0644), "WriteFile should succeed") {
+			return
+		}
+		if !assert.NoError(t, os.Chtimes(filename, longAgo, longAgo), "Chtimes should succeed") {
+			return
+		}
+	}
+
+	cl := clock.NewMock()
+	cl.Add(time.Now().Sub(cl.Now()))
+
+	w, err := apachelog.NewRotatingWriter(
+		filepath.Join(dir, "%Y%m%d"),
+		apachelog.WithClock(cl),
+		apachelog.WithMaxAge(24*time.Hour),
+	)
+	if !assert.NoError(t, err, "NewRotatingWriter should succeed") {
+		return
+	}
+	_, _ = w.Write([]byte("new\n"))
+	if !assert.NoError(t, w.Close(), "Close should succeed") {
+		return
+	}
+
+	assert.Equal(t, []string{"2000", cl.Now().Format("20060102"), "notes.txt"}, listFiles(t, dir), "only files generated by the pattern should be removed")
+}
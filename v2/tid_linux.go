@@ -0,0 +1,12 @@
+//go:build linux
+// +build linux
+
+package apachelog
+
+import "syscall"
+
+// gettid returns the ID of the OS thread the calling goroutine
+// is currently running on
+func gettid() (int, bool) {
+	return syscall.Gettid(), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package apachelog
+
+// gettid is not supported on this platform
+func gettid() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package apachelog
+
+import (
+	"crypto/tls"
+	"strconv"
+)
+
+// tlsKeys are the keys supported by the TLS variants of %{...}x. The
+// names are those of the mod_ssl environment variables, so that
+// formats written for Apache work unchanged. SSL_ALPN is not part of
+// mod_ssl, and contains the protocol negotiated via ALPN
+var tlsKeys = []string{
+	"SSL_PROTOCOL",
+	"SSL_CIPHER",
+	"SSL_TLS_SNI",
+	"SSL_SESSION_RESUMED",
+	"SSL_CLIENT_S_DN",
+	"SSL_CLIENT_I_DN",
+	"SSL_ALPN",
+}
+
+// tlsVersionName returns the name used by mod_ssl for the TLS version v.
+// SSLv3 is not listed, as crypto/tls no longer negotiates it. Unknown
+// versions are logged in hexadecimal
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(v), 16)
+}
+
+// makeTLSField creates a field that extracts the value of the mod_ssl
+// variable key from the TLS connection state of the request. Plain
+// HTTP requests are logged as missing values. Note that SSL_CIPHER
+// uses the IANA names of the cipher suites, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, rather than the OpenSSL ones
+func makeTLSField(key string) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		cs := ctx.Request().TLS
+		if cs == nil {
+			return MissingValue()
+		}
+
+		switch key {
+		case "SSL_PROTOCOL":
+			return StringValue(tlsVersionName(cs.Version))
+		case "SSL_CIPHER":
+			return StringValue(tls.CipherSuiteName(cs.CipherSuite))
+		case "SSL_TLS_SNI":
+			return stringOrMissing(cs.ServerName)
+		case "SSL_SESSION_RESUMED":
+			if cs.DidResume {
+				return StringValue("Resumed")
+			}
+			return StringValue("Initial")
+		case "SSL_CLIENT_S_DN":
+			if len(cs.PeerCertificates) == 0 {
+				return MissingValue()
+			}
+			return stringOrMissing(cs.PeerCertificates[0].Subject.String())
+		case "SSL_CLIENT_I_DN":
+			if len(cs.PeerCertificates) == 0 {
+				return MissingValue()
+			}
+			return stringOrMissing(cs.PeerCertificates[0].Issuer.String())
+		case "SSL_ALPN":
+			return stringOrMissing(cs.NegotiatedProtocol)
+		}
+		return MissingValue()
+	})
+}
@@ -0,0 +1,227 @@
+package apachelog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// traceContext is the distributed tracing context of a request, taken
+// from W3C Trace Context (traceparent and tracestate) or B3 headers
+type traceContext struct {
+	traceID      string // 32 lowercase hex digits
+	spanID       string // 16 lowercase hex digits
+	parentSpanID string
+	flags        string // 2 hex digits, as in traceparent, if known
+	sampled      string // "1" or "0", if known
+	state        string // tracestate
+}
+
+type traceContextKey struct{}
+
+// traceKeys are the keys supported by the trace context variants of
+// %{...}x
+var traceKeys = []string{"trace_id", "span_id", "parent_span_id", "sampled", "trace_flags", "tracestate"}
+
+// isHex checks that s consists of n lowercase hex digits
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isID checks that s is a valid trace or span ID of n hex digits.
+// IDs that are all zeros are invalid
+func isID(s string, n int) bool {
+	return isHex(s, n) && strings.Trim(s, "0") != ""
+}
+
+// parseTraceparent parses a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func parseTraceparent(v string) (traceContext, bool) {
+	v = strings.TrimSpace(v)
+	if len(v) < 55 || (len(v) > 55 && v[55] != '-') {
+		return traceContext{}, false
+	}
+	version, traceID, spanID, flags := v[0:2], v[3:35], v[36:52], v[53:55]
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return traceContext{}, false
+	}
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(v) != 55) {
+		return traceContext{}, false
+	}
+	if !isID(traceID, 32) || !isID(spanID, 16) || !isHex(flags, 2) {
+		return traceContext{}, false
+	}
+
+	sampled := "0"
+	if b, _ := hex.DecodeString(flags); len(b) == 1 && b[0]&1 == 1 {
+		sampled = "1"
+	}
+	return traceContext{traceID: traceID, spanID: spanID, flags: flags, sampled: sampled}, true
+}
+
+// normalizeB3ID converts a B3 ID to lowercase, and pads 64-bit trace
+// IDs to 128 bits
+func normalizeB3ID(id string, n int) (string, bool) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if n == 32 && len(id) == 16 {
+		id = strings.Repeat("0", 16) + id
+	}
+	return id, isID(id, n)
+}
+
+func b3Sampled(v string) string {
+	switch strings.ToLower(v) {
+	case "1", "true", "d":
+		return "1"
+	case "0", "false":
+		return "0"
+	}
+	return ""
+}
+
+// parseB3 parses a single b3 header, e.g.
+// "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"
+func parseB3(v string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return traceContext{}, false
+	}
+
+	var tc traceContext
+	var ok bool
+	if tc.traceID, ok = normalizeB3ID(parts[0], 32); !ok {
+		return traceContext{}, false
+	}
+	if tc.spanID, ok = normalizeB3ID(parts[1], 16); !ok {
+		return traceContext{}, false
+	}
+	if len(parts) > 2 {
+		tc.sampled = b3Sampled(parts[2])
+	}
+	if len(parts) > 3 {
+		if tc.parentSpanID, ok = normalizeB3ID(parts[3], 16); !ok {
+			return traceContext{}, false
+		}
+	}
+	return tc, true
+}
+
+// parseB3Multi parses the X-B3-* headers
+func parseB3Multi(h http.Header) (traceContext, bool) {
+	var tc traceContext
+	var ok bool
+	if tc.traceID, ok = normalizeB3ID(h.Get("X-B3-TraceId"), 32); !ok {
+		return traceContext{}, false
+	}
+	if tc.spanID, ok = normalizeB3ID(h.Get("X-B3-SpanId"), 16); !ok {
+		return traceContext{}, false
+	}
+	if v := h.Get("X-B3-ParentSpanId"); v != "" {
+		if tc.parentSpanID, ok = normalizeB3ID(v, 16); !ok {
+			return traceContext{}, false
+		}
+	}
+	tc.sampled = b3Sampled(h.Get("X-B3-Sampled"))
+	if h.Get("X-B3-Flags") == "1" { // debug implies sampled
+		tc.sampled = "1"
+	}
+	return tc, true
+}
+
+// parseTraceContext extracts the trace context from the headers of a
+// request. traceparent takes precedence over b3, which takes
+// precedence over the X-B3-* headers
+func parseTraceContext(h http.Header) (traceContext, bool) {
+	if v := h.Get("traceparent"); v != "" {
+		tc, ok := parseTraceparent(v)
+		if ok {
+			tc.state = strings.Join(h["Tracestate"], ",")
+		}
+		return tc, ok
+	}
+	if v := h.Get("b3"); v != "" {
+		return parseB3(v)
+	}
+	return parseB3Multi(h)
+}
+
+func randomHex(n int) string {
+	for {
+		b := make([]byte, n)
+		_, _ = rand.Read(b)
+		if s := hex.EncodeToString(b); strings.Trim(s, "0") != "" {
+			return s
+		}
+	}
+}
+
+// newChildSpan creates a new span that is a child of the trace context
+// of r. If r does not have a trace context, a new trace is started
+func newChildSpan(r *http.Request) *traceContext {
+	tc, ok := parseTraceContext(r.Header)
+	if !ok {
+		return &traceContext{traceID: randomHex(16), spanID: randomHex(8)}
+	}
+
+	tc.parentSpanID = tc.spanID
+	tc.spanID = randomHex(8)
+	return &tc
+}
+
+// requestTraceContext returns the trace context of r. This is the
+// child span started by ApacheLog.Wrap if WithChildSpan was specified,
+// otherwise it is parsed from the headers
+func requestTraceContext(r *http.Request) (traceContext, bool) {
+	if tc, ok := r.Context().Value(traceContextKey{}).(*traceContext); ok {
+		return *tc, true
+	}
+	return parseTraceContext(r.Header)
+}
+
+// TraceIDsFromContext returns the trace ID and span ID of the request
+// whose context is ctx, as logged by %{trace_id}x and %{span_id}x.
+// It only reports IDs when ApacheLog.Wrap was configured to start a
+// child span using WithChildSpan
+func TraceIDsFromContext(ctx context.Context) (traceID, spanID string, ok bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(*traceContext)
+	if !ok {
+		return "", "", false
+	}
+	return tc.traceID, tc.spanID, true
+}
+
+func makeTraceField(key string) *builtinField {
+	return newField(func(ctx LogCtx) Value {
+		tc, ok := requestTraceContext(ctx.Request())
+		if !ok {
+			return MissingValue()
+		}
+
+		switch key {
+		case "trace_id":
+			return stringOrMissing(tc.traceID)
+		case "span_id":
+			return stringOrMissing(tc.spanID)
+		case "parent_span_id":
+			return stringOrMissing(tc.parentSpanID)
+		case "sampled":
+			return stringOrMissing(tc.sampled)
+		case "trace_flags":
+			return stringOrMissing(tc.flags)
+		case "tracestate":
+			return stringOrMissing(tc.state)
+		}
+		return MissingValue()
+	})
+}